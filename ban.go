@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+)
+
+const (
+	BAN_KIND_TEMPORARY = "temporary"
+	BAN_KIND_PERMANENT = "permanent"
+)
+
+type BanStats struct {
+	Temporary     uint64    `json:"temporary"`
+	Permanent     uint64    `json:"permanent"`
+	LastBan       time.Time `json:"last_ban,omitempty"`
+	LastBanKind   string    `json:"last_ban_kind,omitempty"`
+	CooldownUntil time.Time `json:"cooldown_until,omitempty"`
+}
+
+// BanMonitor tracks bans reported by background_init. Temporary bans put
+// bootstrap attempts of affected identity on exponentially growing cooldown,
+// permanent bans invoke onPermanent handler. Permanent bans of several
+// identities within initial cooldown are a single ban episode and invoke
+// handler once.
+type BanMonitor struct {
+	mux           sync.Mutex
+	logger        *CondLogger
+	cooldown      time.Duration
+	maxCooldown   time.Duration
+	cooldowns     map[int]*banCooldown
+	stats         BanStats
+	lastPermanent time.Time
+	onPermanent   func()
+}
+
+// banCooldown is a cooldown state of a single identity
+type banCooldown struct {
+	backoff *backoff.ExponentialBackOff
+	until   time.Time
+}
+
+func NewBanMonitor(cooldown, maxCooldown time.Duration, logger *CondLogger, onPermanent func()) *BanMonitor {
+	return &BanMonitor{
+		logger:      logger,
+		cooldown:    cooldown,
+		maxCooldown: maxCooldown,
+		cooldowns:   make(map[int]*banCooldown),
+		onPermanent: onPermanent,
+	}
+}
+
+func (m *BanMonitor) newCooldown() *banCooldown {
+	bo := &backoff.ExponentialBackOff{
+		InitialInterval:     m.cooldown,
+		RandomizationFactor: 0.5,
+		Multiplier:          2,
+		MaxInterval:         m.maxCooldown,
+		MaxElapsedTime:      0,
+		Stop:                backoff.Stop,
+		Clock:               backoff.SystemClock,
+	}
+	bo.Reset()
+	return &banCooldown{
+		backoff: bo,
+	}
+}
+
+// Report inspects error of identity bootstrap and accounts it if it is a
+// ban. Returns true if error is a ban.
+func (m *BanMonitor) Report(ident int, err error) bool {
+	var kind string
+	switch {
+	case errors.Is(err, TemporaryBanError):
+		kind = BAN_KIND_TEMPORARY
+	case errors.Is(err, PermanentBanError):
+		kind = BAN_KIND_PERMANENT
+	default:
+		return false
+	}
+
+	events.Emit(EVENT_BAN_DETECTED, map[string]string{
+		"identity": strconv.Itoa(ident),
+		"kind":     kind,
+	})
+
+	m.mux.Lock()
+	now := time.Now()
+	m.stats.LastBan = now
+	m.stats.LastBanKind = kind
+	if kind == BAN_KIND_TEMPORARY {
+		m.stats.Temporary++
+		cd := m.cooldowns[ident]
+		if cd == nil {
+			cd = m.newCooldown()
+			m.cooldowns[ident] = cd
+		}
+		cooldown := cd.backoff.NextBackOff()
+		cd.until = now.Add(cooldown)
+		m.mux.Unlock()
+		m.logger.Warning("Temporary ban of identity #%d detected. Cooling down for %v.",
+			ident, cooldown.Truncate(time.Second))
+		return true
+	}
+	m.stats.Permanent++
+	handle := m.lastPermanent.IsZero() || now.Sub(m.lastPermanent) >= m.cooldown
+	if handle {
+		m.lastPermanent = now
+	}
+	m.mux.Unlock()
+	m.logger.Error("Permanent ban of identity #%d detected. User ID will be replaced.", ident)
+	if !handle {
+		m.logger.Debug("Permanent ban of identity #%d belongs to recent ban episode, which is already handled.", ident)
+		return true
+	}
+	if m.onPermanent != nil {
+		m.onPermanent()
+	}
+	return true
+}
+
+// Reset clears cooldown of identity after its successful bootstrap.
+func (m *BanMonitor) Reset(ident int) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	delete(m.cooldowns, ident)
+}
+
+// CooldownUntil returns time when cooldown of identity caused by temporary
+// ban is over.
+func (m *BanMonitor) CooldownUntil(ident int) time.Time {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if cd := m.cooldowns[ident]; cd != nil {
+		return cd.until
+	}
+	return time.Time{}
+}
+
+// Wait blocks until cooldown of identity caused by temporary ban is over.
+func (m *BanMonitor) Wait(ctx context.Context, ident int) error {
+	delay := time.Until(m.CooldownUntil(ident))
+	if delay <= 0 {
+		return nil
+	}
+	m.logger.Info("Identity #%d is waiting %v for temporary ban cooldown to end...",
+		ident, delay.Truncate(time.Second))
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Stats returns ban counters. CooldownUntil reports the latest cooldown
+// among identities.
+func (m *BanMonitor) Stats() BanStats {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	st := m.stats
+	for _, cd := range m.cooldowns {
+		if cd.until.After(st.CooldownUntil) {
+			st.CooldownUntil = cd.until
+		}
+	}
+	return st
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestBanMonitorBackoff(t *testing.T) {
+	const cooldown = time.Second
+	m := NewBanMonitor(cooldown, 4*cooldown, testLogger(t, "BAN     : "), nil)
+	check := func(interval time.Duration) {
+		t.Helper()
+		start := time.Now()
+		if !m.Report(0, fmt.Errorf("bootstrap: %w", TemporaryBanError)) {
+			t.Fatal("temporary ban is not recognized")
+		}
+		got := m.CooldownUntil(0).Sub(start)
+		// Randomization factor is 0.5
+		if got < interval/2 || got > interval*3/2+100*time.Millisecond {
+			t.Errorf("got cooldown %v, want %v +/-50%%", got, interval)
+		}
+	}
+
+	// Cooldown grows up to maximal one
+	for _, interval := range []time.Duration{1, 2, 4, 4, 4} {
+		check(interval * cooldown)
+	}
+	m.Reset(0)
+	if until := m.CooldownUntil(0); !until.IsZero() {
+		t.Errorf("cooldown is not cleared by reset: %v", until)
+	}
+	// Growth starts over after reset
+	check(cooldown)
+
+	st := m.Stats()
+	if st.Temporary != 6 || st.Permanent != 0 || st.LastBanKind != BAN_KIND_TEMPORARY {
+		t.Errorf("unexpected stats: %+v", st)
+	}
+	if st.CooldownUntil != m.CooldownUntil(0) {
+		t.Errorf("stats report cooldown until %v, want %v", st.CooldownUntil, m.CooldownUntil(0))
+	}
+}
+
+func TestBanMonitorPerIdentity(t *testing.T) {
+	m := NewBanMonitor(time.Hour, time.Hour, testLogger(t, "BAN     : "), nil)
+	m.Report(0, TemporaryBanError)
+	m.Report(1, TemporaryBanError)
+	m.Reset(1)
+	if m.CooldownUntil(0).IsZero() {
+		t.Error("reset of identity #1 cleared cooldown of identity #0")
+	}
+
+	if err := m.Wait(context.Background(), 1); err != nil {
+		t.Errorf("identity without cooldown waited: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := m.Wait(ctx, 0); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want wait until context deadline", err)
+	}
+}
+
+func TestBanMonitorPermanent(t *testing.T) {
+	switched := 0
+	m := NewBanMonitor(time.Hour, time.Hour, testLogger(t, "BAN     : "), func() {
+		switched++
+	})
+	if m.Report(0, errors.New("connection refused")) {
+		t.Error("non-ban error is reported as ban")
+	}
+	if !m.Report(0, PermanentBanError) {
+		t.Fatal("permanent ban is not recognized")
+	}
+	// Bans of other identities in the same episode are handled once
+	for ident := 1; ident < 4; ident++ {
+		m.Report(ident, PermanentBanError)
+	}
+	if switched != 1 {
+		t.Errorf("permanent ban handler called %d times, want 1", switched)
+	}
+	if !m.CooldownUntil(0).IsZero() {
+		t.Error("permanent ban put identity on cooldown")
+	}
+	if st := m.Stats(); st.Permanent != 4 || st.Temporary != 0 || st.LastBanKind != BAN_KIND_PERMANENT {
+		t.Errorf("unexpected stats: %+v", st)
+	}
+}
+
+func TestBanMonitorPermanentEpisodes(t *testing.T) {
+	switched := 0
+	m := NewBanMonitor(50*time.Millisecond, time.Hour, testLogger(t, "BAN     : "), func() {
+		switched++
+	})
+	m.Report(0, PermanentBanError)
+	time.Sleep(100 * time.Millisecond)
+	m.Report(1, PermanentBanError)
+	if switched != 2 {
+		t.Errorf("permanent ban handler called %d times, want 2", switched)
+	}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	BENCH_MODE_CONNECT = "connect"
+	BENCH_MODE_H2      = "h2"
+	BENCH_MODE_REQUEST = "request"
+)
+
+// BenchEnv is an in-process ProxyHandler with a direct upstream and local
+// sinks, so only proxy's own overhead is measured.
+type BenchEnv struct {
+	ProxyAddr    string
+	EchoAddr     string
+	HTTPSinkAddr string
+	listeners    []net.Listener
+	servers      []*http.Server
+	h1Client     *http.Client
+	h2Client     *http.Client
+}
+
+func StartBenchEnv(logger *CondLogger) (*BenchEnv, error) {
+	env := &BenchEnv{}
+	listen := func() (net.Listener, error) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			env.Close()
+			return nil, err
+		}
+		env.listeners = append(env.listeners, l)
+		return l, nil
+	}
+	serve := func(l net.Listener, srv *http.Server) {
+		env.servers = append(env.servers, srv)
+		go srv.Serve(l)
+	}
+
+	echo, err := listen()
+	if err != nil {
+		return nil, err
+	}
+	env.EchoAddr = echo.Addr().String()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	sink, err := listen()
+	if err != nil {
+		return nil, err
+	}
+	env.HTTPSinkAddr = sink.Addr().String()
+	serve(sink, &http.Server{Handler: http.HandlerFunc(benchSinkHandler)})
+
+	direct := &net.Dialer{}
+	upstream := &StaticUpstream{
+		Name:          "bench",
+		Endpoint:      &Endpoint{Host: "127.0.0.1"},
+		Dialer:        direct,
+		RequestDialer: NewPlaintextDialer(env.HTTPSinkAddr, "", nil, false, direct),
+		Auth: func() string {
+			return ""
+		},
+	}
+	proxyListener, err := listen()
+	if err != nil {
+		return nil, err
+	}
+	env.ProxyAddr = proxyListener.Addr().String()
+	protocols := &http.Protocols{}
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(true)
+	serve(proxyListener, &http.Server{
+		Handler:   NewProxyHandler(upstream, &net.Resolver{}, nil, FAMILY_ANY, TunnelLimits{}, logger),
+		Protocols: protocols,
+	})
+
+	env.h1Client = &http.Client{
+		Transport: &http.Transport{
+			Proxy:               http.ProxyURL(&url.URL{Scheme: "http", Host: env.ProxyAddr}),
+			MaxIdleConnsPerHost: 1024,
+		},
+	}
+	h2Protocols := &http.Protocols{}
+	h2Protocols.SetUnencryptedHTTP2(true)
+	env.h2Client = &http.Client{
+		Transport: &http.Transport{
+			Protocols: h2Protocols,
+		},
+	}
+	return env, nil
+}
+
+func benchSinkHandler(wr http.ResponseWriter, req *http.Request) {
+	size, err := strconv.ParseInt(req.URL.Query().Get("size"), 10, 64)
+	if err != nil || size < 0 {
+		http.Error(wr, "bad size", http.StatusBadRequest)
+		return
+	}
+	wr.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	io.CopyN(wr, benchZeroReader{}, size)
+}
+
+type benchZeroReader struct{}
+
+func (benchZeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+func (e *BenchEnv) Close() {
+	for _, srv := range e.servers {
+		srv.Close()
+	}
+	for _, l := range e.listeners {
+		l.Close()
+	}
+	if e.h1Client != nil {
+		e.h1Client.CloseIdleConnections()
+		e.h2Client.CloseIdleConnections()
+	}
+}
+
+// echoPayload sends payload through tunnel and reads it back
+func echoPayload(w io.Writer, r io.Reader, payload []byte) error {
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := w.Write(payload)
+		errCh <- err
+	}()
+	if _, err := io.CopyN(io.Discard, r, int64(len(payload))); err != nil {
+		return fmt.Errorf("tunnel read failed: %w", err)
+	}
+	return <-errCh
+}
+
+// Connect opens HTTP/1.1 CONNECT tunnel to echo sink, pumps payload through
+// it and returns tunnel setup latency.
+func (e *BenchEnv) Connect(ctx context.Context, payload []byte) (time.Duration, error) {
+	start := time.Now()
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", e.ProxyAddr)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	if _, err := fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", e.EchoAddr, e.EchoAddr); err != nil {
+		return 0, err
+	}
+	resp, tunnel, err := readResponse(ctx, conn, &http.Request{Method: PROXY_CONNECT_METHOD})
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("bad CONNECT response: %s", resp.Status)
+	}
+	setup := time.Since(start)
+	return setup, echoPayload(tunnel, tunnel, payload)
+}
+
+// ConnectH2 does the same as Connect over HTTP/2 stream
+func (e *BenchEnv) ConnectH2(ctx context.Context, payload []byte) (time.Duration, error) {
+	start := time.Now()
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	req, err := http.NewRequestWithContext(ctx, http.MethodConnect, "http://"+e.ProxyAddr, pr)
+	if err != nil {
+		return 0, err
+	}
+	req.Host = e.EchoAddr
+	resp, err := e.h2Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("bad CONNECT response: %s", resp.Status)
+	}
+	setup := time.Since(start)
+	return setup, echoPayload(pw, resp.Body, payload)
+}
+
+// Request fetches size bytes from HTTP sink through proxy and returns time
+// to response headers.
+func (e *BenchEnv) Request(ctx context.Context, size int) (time.Duration, error) {
+	start := time.Now()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		"http://"+e.HTTPSinkAddr+"/bulk?size="+strconv.Itoa(size), nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := e.h1Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	setup := time.Since(start)
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("bad response: %s", resp.Status)
+	}
+	n, err := io.Copy(io.Discard, resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	if n != int64(size) {
+		return 0, fmt.Errorf("short response body: %d of %d bytes", n, size)
+	}
+	return setup, nil
+}
+
+// Round performs single exchange of given mode
+func (e *BenchEnv) Round(ctx context.Context, mode string, payload []byte) (time.Duration, error) {
+	switch mode {
+	case BENCH_MODE_CONNECT:
+		return e.Connect(ctx, payload)
+	case BENCH_MODE_H2:
+		return e.ConnectH2(ctx, payload)
+	case BENCH_MODE_REQUEST:
+		return e.Request(ctx, len(payload))
+	default:
+		return 0, fmt.Errorf("unknown bench mode %q", mode)
+	}
+}
+
+type BenchResult struct {
+	Mode        string
+	Connections int
+	Bytes       int64
+	Elapsed     time.Duration
+	Setup       []time.Duration
+	Mallocs     uint64
+}
+
+func (r *BenchResult) sortSetup() {
+	sort.Slice(r.Setup, func(i, j int) bool { return r.Setup[i] < r.Setup[j] })
+}
+
+// Percentile returns setup latency percentile. Setup durations have to be
+// sorted.
+func (r *BenchResult) Percentile(p float64) time.Duration {
+	if len(r.Setup) == 0 {
+		return 0
+	}
+	idx := int(float64(len(r.Setup)-1) * p)
+	return r.Setup[idx]
+}
+
+func (r *BenchResult) String() string {
+	mbps := float64(r.Bytes) / r.Elapsed.Seconds() / (1 << 20)
+	return fmt.Sprintf("%s: %d connections, %.1f MiB/s, setup p50=%v p99=%v, %.0f allocs/conn",
+		r.Mode, r.Connections, mbps, r.Percentile(0.5), r.Percentile(0.99),
+		float64(r.Mallocs)/float64(r.Connections))
+}
+
+// RunBench performs connections rounds of mode with given concurrency.
+// Allocations are counted process-wide, so they include client side too.
+func RunBench(ctx context.Context, env *BenchEnv, mode string, connections, concurrency, size int) (*BenchResult, error) {
+	if connections < 1 || concurrency < 1 {
+		return nil, errors.New("connections and concurrency should be positive")
+	}
+	payload := make([]byte, size)
+	res := &BenchResult{
+		Mode:        mode,
+		Connections: connections,
+		Setup:       make([]time.Duration, 0, connections),
+	}
+	var (
+		mux      sync.Mutex
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	jobs := make(chan struct{})
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range jobs {
+				setup, err := env.Round(ctx, mode, payload)
+				mux.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+				res.Setup = append(res.Setup, setup)
+				mux.Unlock()
+			}
+		}()
+	}
+	for i := 0; i < connections; i++ {
+		jobs <- struct{}{}
+	}
+	close(jobs)
+	wg.Wait()
+	res.Elapsed = time.Since(start)
+	runtime.ReadMemStats(&after)
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	res.Mallocs = after.Mallocs - before.Mallocs
+	res.Bytes = int64(connections) * int64(size)
+	res.sortSetup()
+	return res, nil
+}
+
+func runBench(argv []string) int {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	mode := fs.String("mode", "", "bench only this mode: "+BENCH_MODE_CONNECT+", "+BENCH_MODE_H2+" or "+
+		BENCH_MODE_REQUEST+". All modes are run if empty")
+	connections := fs.Int("connections", 1000, "number of connections per mode")
+	concurrency := fs.Int("concurrency", 16, "number of simultaneous connections")
+	size := fs.Int("size", 1024*1024, "bytes transferred through each connection")
+	verbosity := fs.Int("verbosity", 40, "logging verbosity "+
+		"(10 - debug, 20 - info, 30 - warning, 40 - error, 50 - critical)")
+	fs.Parse(argv)
+
+	logWriter := NewLogWriter(os.Stderr)
+	defer logWriter.Close()
+	logger := NewCondLogger(log.New(logWriter, "BENCH   : ",
+		log.LstdFlags|log.Lshortfile),
+		*verbosity)
+
+	env, err := StartBenchEnv(logger)
+	if err != nil {
+		logger.Critical("Can't start bench environment: %v", err)
+		return 3
+	}
+	defer env.Close()
+
+	modes := []string{BENCH_MODE_CONNECT, BENCH_MODE_H2, BENCH_MODE_REQUEST}
+	if *mode != "" {
+		modes = []string{*mode}
+	}
+	for _, m := range modes {
+		res, err := RunBench(context.Background(), env, m, *connections, *concurrency, *size)
+		if err != nil {
+			logger.Critical("Bench %s failed: %v", m, err)
+			return 1
+		}
+		fmt.Println(res)
+	}
+	return 0
+}
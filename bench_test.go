@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"testing"
+)
+
+const benchPayloadSize = 256 * 1024
+
+func benchProxyHandler(b *testing.B, mode string) {
+	env, err := StartBenchEnv(NewCondLogger(log.New(io.Discard, "", 0), CRITICAL))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer env.Close()
+	payload := make([]byte, benchPayloadSize)
+	res := &BenchResult{Mode: mode}
+	b.SetBytes(benchPayloadSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		setup, err := env.Round(context.Background(), mode, payload)
+		if err != nil {
+			b.Fatal(err)
+		}
+		res.Setup = append(res.Setup, setup)
+	}
+	b.StopTimer()
+	res.sortSetup()
+	b.ReportMetric(float64(res.Percentile(0.5).Microseconds()), "p50-setup-us")
+	b.ReportMetric(float64(res.Percentile(0.99).Microseconds()), "p99-setup-us")
+}
+
+func BenchmarkProxyHandlerConnect(b *testing.B) {
+	benchProxyHandler(b, BENCH_MODE_CONNECT)
+}
+
+func BenchmarkProxyHandlerH2(b *testing.B) {
+	benchProxyHandler(b, BENCH_MODE_H2)
+}
+
+func BenchmarkProxyHandlerRequest(b *testing.B) {
+	benchProxyHandler(b, BENCH_MODE_REQUEST)
+}
+
+// tcpPair returns both ends of loopback TCP connection
+func tcpPair(b testing.TB) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := l.Accept()
+		accepted <- conn
+	}()
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	server := <-accepted
+	if server == nil {
+		b.Fatal("accept failed")
+	}
+	return client, server
+}
+
+func BenchmarkProxy(b *testing.B) {
+	payload := make([]byte, benchPayloadSize)
+	b.SetBytes(benchPayloadSize)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		client, left := tcpPair(b)
+		right, sink := tcpPair(b)
+		b.StartTimer()
+		done := make(chan struct{})
+		go func() {
+			proxy(context.Background(), left, right, TunnelLimits{})
+			close(done)
+		}()
+		go func() {
+			io.Copy(sink, sink)
+			sink.Close()
+		}()
+		if err := echoPayload(client, client, payload); err != nil {
+			b.Fatal(err)
+		}
+		client.Close()
+		<-done
+	}
+}
+
+func BenchmarkCopyBody(b *testing.B) {
+	b.SetBytes(benchPayloadSize)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		copyBody(io.Discard, io.LimitReader(benchZeroReader{}, benchPayloadSize))
+	}
+}
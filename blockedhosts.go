@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_BLOCKED_TTL        = 24 * time.Hour
+	DEFAULT_BLOCKED_CACHE_SIZE = 4096
+	// Delay of saving learned hosts, so burst of learned hosts is saved once
+	BLOCKED_SAVE_DELAY = 5 * time.Second
+)
+
+//go:embed blocked-domains.txt
+var bundledBlockedDomains string
+
+type BlockedHostsStats struct {
+	Learned uint64 `json:"learned"`
+	Cached  int    `json:"cached"`
+	Seeded  int    `json:"seeded"`
+	Hits    uint64 `json:"hits"`
+}
+
+// BlockedHosts remembers hostnames refused by upstream, so connections to
+// them can skip doomed CONNECT attempt. Learned hosts expire after ttl and
+// their number is bounded by size. Seeded domains never expire and match
+// their subdomains as well.
+type BlockedHosts struct {
+	mux       sync.Mutex
+	saveMux   sync.Mutex
+	ttl       time.Duration
+	size      int
+	path      string
+	logger    *CondLogger
+	learned   map[string]time.Time
+	seeded    map[string]struct{}
+	stats     BlockedHostsStats
+	dirty     bool
+	saveTimer *time.Timer
+}
+
+// NewBlockedHosts creates cache of blocked hostnames. If path is not empty,
+// learned hosts are saved into that file in background.
+func NewBlockedHosts(ttl time.Duration, size int, path string, logger *CondLogger) *BlockedHosts {
+	return &BlockedHosts{
+		ttl:     ttl,
+		size:    size,
+		path:    path,
+		logger:  logger,
+		learned: make(map[string]time.Time),
+		seeded:  make(map[string]struct{}),
+	}
+}
+
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// Seed adds domains listed in r, one per line. Empty lines and lines
+// starting with # are ignored.
+func (b *BlockedHosts) Seed(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		b.seeded[normalizeHost(line)] = struct{}{}
+	}
+	b.stats.Seeded = len(b.seeded)
+	return scanner.Err()
+}
+
+// SeedBundled adds domains from list bundled into program
+func (b *BlockedHosts) SeedBundled() error {
+	return b.Seed(strings.NewReader(bundledBlockedDomains))
+}
+
+// Blocked reports if host is known to be blocked by upstream
+func (b *BlockedHosts) Blocked(host string) bool {
+	host = normalizeHost(host)
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if expires, ok := b.learned[host]; ok {
+		if time.Now().Before(expires) {
+			b.stats.Hits++
+			return true
+		}
+		delete(b.learned, host)
+	}
+	for domain := host; domain != ""; {
+		if _, ok := b.seeded[domain]; ok {
+			b.stats.Hits++
+			return true
+		}
+		_, parent, found := strings.Cut(domain, ".")
+		if !found {
+			break
+		}
+		domain = parent
+	}
+	return false
+}
+
+// Learn remembers host as blocked. If cache is persistent, it is saved
+// within BLOCKED_SAVE_DELAY.
+func (b *BlockedHosts) Learn(host string) {
+	if b.size <= 0 {
+		return
+	}
+	host = normalizeHost(host)
+	now := time.Now()
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if _, ok := b.learned[host]; !ok && len(b.learned) >= b.size {
+		b.evict(now)
+	}
+	b.learned[host] = now.Add(b.ttl)
+	b.stats.Learned++
+	if b.path == "" {
+		return
+	}
+	b.dirty = true
+	if b.saveTimer == nil {
+		b.saveTimer = time.AfterFunc(BLOCKED_SAVE_DELAY, func() {
+			if err := b.save(false); err != nil {
+				b.logger.Warning("Unable to save blocked hosts cache: %v", err)
+			}
+		})
+	}
+}
+
+// evict drops expired entries or, if there are none, entry closest to
+// expiration. Has to be called with lock held.
+func (b *BlockedHosts) evict(now time.Time) {
+	var (
+		oldest        string
+		oldestExpires time.Time
+	)
+	for host, expires := range b.learned {
+		if !now.Before(expires) {
+			delete(b.learned, host)
+			continue
+		}
+		if oldest == "" || expires.Before(oldestExpires) {
+			oldest, oldestExpires = host, expires
+		}
+	}
+	if len(b.learned) >= b.size && oldest != "" {
+		delete(b.learned, oldest)
+	}
+}
+
+// Load reads learned hosts saved by previous run. Missing file is not an
+// error.
+func (b *BlockedHosts) Load() error {
+	if b.path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(b.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	var saved map[string]time.Time
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return err
+	}
+	now := time.Now()
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	for host, expires := range saved {
+		if !now.Before(expires) {
+			continue
+		}
+		if len(b.learned) >= b.size {
+			b.evict(now)
+		}
+		if b.size > 0 {
+			b.learned[normalizeHost(host)] = expires
+		}
+	}
+	return nil
+}
+
+// Save atomically writes learned hosts into cache file
+func (b *BlockedHosts) Save() error {
+	return b.save(true)
+}
+
+// Flush writes changes pending for delayed save, if any.
+func (b *BlockedHosts) Flush() error {
+	if b.path == "" {
+		return nil
+	}
+	return b.save(false)
+}
+
+// save writes snapshot of learned hosts. Saves are serialized, so older
+// snapshot never overwrites newer one. Unless force is set, cache is written
+// only if it has changed since last snapshot.
+func (b *BlockedHosts) save(force bool) error {
+	b.saveMux.Lock()
+	defer b.saveMux.Unlock()
+	b.mux.Lock()
+	if b.saveTimer != nil {
+		b.saveTimer.Stop()
+		b.saveTimer = nil
+	}
+	if !force && !b.dirty {
+		b.mux.Unlock()
+		return nil
+	}
+	b.dirty = false
+	data, err := json.Marshal(b.learned)
+	b.mux.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := b.write(data); err != nil {
+		b.mux.Lock()
+		b.dirty = true
+		b.mux.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (b *BlockedHosts) write(data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(b.path), filepath.Base(b.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), b.path)
+}
+
+func (b *BlockedHosts) Stats() BlockedHostsStats {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	stats := b.stats
+	stats.Cached = len(b.learned)
+	return stats
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type staticResolver map[string][]netip.Addr
+
+func (r staticResolver) LookupNetIP(_ context.Context, _, host string) ([]netip.Addr, error) {
+	return r[host], nil
+}
+
+func TestBlockedHostsSeed(t *testing.T) {
+	b := NewBlockedHosts(time.Hour, 10, "", nil)
+	if err := b.Seed(strings.NewReader("# comment\n\nExample.com\nmail.test.\n")); err != nil {
+		t.Fatal(err)
+	}
+	for host, want := range map[string]bool{
+		"example.com":     true,
+		"www.example.com": true,
+		"EXAMPLE.COM.":    true,
+		"notexample.com":  false,
+		"com":             false,
+		"mail.test":       true,
+		"test":            false,
+	} {
+		if got := b.Blocked(host); got != want {
+			t.Errorf("Blocked(%q) = %v, want %v", host, got, want)
+		}
+	}
+	if err := b.SeedBundled(); err != nil {
+		t.Fatal(err)
+	}
+	if !b.Blocked("digitalocean.com") {
+		t.Error("bundled list is not seeded")
+	}
+}
+
+func TestBlockedHostsLearn(t *testing.T) {
+	b := NewBlockedHosts(time.Hour, 2, "", nil)
+	b.Learn("a.test")
+	b.Learn("b.test")
+	b.Learn("c.test")
+	if b.Blocked("a.test") || !b.Blocked("b.test") || !b.Blocked("c.test") {
+		t.Errorf("oldest entry is not evicted: %+v", b.Stats())
+	}
+	if b.Blocked("sub.b.test") {
+		t.Error("learned host matches subdomain")
+	}
+
+	b = NewBlockedHosts(-time.Second, 2, "", nil)
+	b.Learn("a.test")
+	if b.Blocked("a.test") {
+		t.Error("expired entry matches")
+	}
+}
+
+func TestBlockedHostsPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocked.json")
+	b := NewBlockedHosts(time.Hour, 10, path, testLogger(t, "BLOCKED : "))
+	if err := b.Load(); err != nil {
+		t.Fatalf("missing cache file is not ignored: %v", err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			b.Learn(fmt.Sprintf("%c.test", 'a'+i))
+		}(i)
+	}
+	wg.Wait()
+	// Save is delayed, so burst of learned hosts doesn't cause writes
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("cache is saved in request path: %v", err)
+	}
+	if err := b.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	b = NewBlockedHosts(time.Hour, 10, path, testLogger(t, "BLOCKED : "))
+	if err := b.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if st := b.Stats(); st.Cached != 10 {
+		t.Errorf("restored %d hosts, want 10", st.Cached)
+	}
+	if !b.Blocked("a.test") {
+		t.Error("learned host is not restored")
+	}
+
+	// Disabled learning doesn't rewrite cache
+	path = filepath.Join(t.TempDir(), "blocked.json")
+	b = NewBlockedHosts(time.Hour, 0, path, testLogger(t, "BLOCKED : "))
+	b.Learn("a.test")
+	if err := b.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("cache is saved with learning disabled: %v", err)
+	}
+}
+
+func TestRetryDialerSkipsKnownBlocked(t *testing.T) {
+	target := startEchoServer(t)
+	host, port, _ := net.SplitHostPort(target)
+	var byName int
+	dialer := dialerFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+		h, _, _ := net.SplitHostPort(address)
+		if net.ParseIP(h) == nil {
+			byName++
+			return nil, UpstreamBlockedError
+		}
+		return (&net.Dialer{}).DialContext(ctx, network, address)
+	})
+	resolver := staticResolver{"blocked.test": {netip.MustParseAddr(host)}}
+	d := NewRetryDialer(dialer, resolver, NewBlockedHosts(time.Hour, 10, "", nil), FAMILY_ANY, testLogger(t, "RETRY   : "))
+	for i := 0; i < 3; i++ {
+		conn, err := d.DialContext(context.Background(), "tcp", net.JoinHostPort("blocked.test", port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+	if byName != 1 {
+		t.Errorf("blocked host was dialed by name %d times, want 1", byName)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	SMALL_COPY_BUF              = 4 * 1024
+	DEFAULT_BUFFER_MEMORY_LIMIT = 64 * 1024 * 1024
+)
+
+// BufferPool hands out copy buffers. Once memory held by large buffers in
+// use reaches limit, small buffers are handed out instead, so throughput
+// degrades under load rather than memory usage growing.
+type BufferPool struct {
+	large     sync.Pool
+	small     sync.Pool
+	largeSize int
+	smallSize int
+	limit     atomic.Int64
+	inUse     atomic.Int64
+}
+
+func NewBufferPool(largeSize, smallSize int, limit int64) *BufferPool {
+	p := &BufferPool{
+		largeSize: largeSize,
+		smallSize: smallSize,
+	}
+	p.large.New = func() any {
+		b := make([]byte, largeSize)
+		return &b
+	}
+	p.small.New = func() any {
+		b := make([]byte, smallSize)
+		return &b
+	}
+	p.limit.Store(limit)
+	return p
+}
+
+func (p *BufferPool) SetLimit(limit int64) {
+	p.limit.Store(limit)
+}
+
+func (p *BufferPool) Get() *[]byte {
+	size := int64(p.largeSize)
+	if p.inUse.Add(size) <= p.limit.Load() {
+		return p.large.Get().(*[]byte)
+	}
+	p.inUse.Add(-size)
+	return p.small.Get().(*[]byte)
+}
+
+func (p *BufferPool) Put(b *[]byte) {
+	switch len(*b) {
+	case p.largeSize:
+		p.inUse.Add(-int64(p.largeSize))
+		p.large.Put(b)
+	case p.smallSize:
+		p.small.Put(b)
+	}
+}
+
+type BufferPoolStats struct {
+	InUse int64 `json:"in_use"`
+	Limit int64 `json:"limit"`
+}
+
+func (p *BufferPool) Stats() BufferPoolStats {
+	return BufferPoolStats{
+		InUse: p.inUse.Load(),
+		Limit: p.limit.Load(),
+	}
+}
+
+var copyBuffers = NewBufferPool(COPY_BUF, SMALL_COPY_BUF, DEFAULT_BUFFER_MEMORY_LIMIT)
+
+// SetBufferMemoryLimit bounds memory held by large copy buffers in use
+func SetBufferMemoryLimit(limit int64) {
+	copyBuffers.SetLimit(limit)
+}
+
+// Wrappers hiding io.ReaderFrom and io.WriterTo, so io.CopyBuffer really
+// uses supplied buffer.
+type onlyReader struct {
+	io.Reader
+}
+
+type onlyWriter struct {
+	io.Writer
+}
+
+// copyStream copies src to dst. Transfers between raw TCP sockets are left
+// to the kernel (splice on Linux), others use pooled buffer.
+func copyStream(dst io.Writer, src io.Reader) (int64, error) {
+	_, dstTCP := dst.(*net.TCPConn)
+	_, srcTCP := src.(*net.TCPConn)
+	if dstTCP && srcTCP {
+		return io.Copy(dst, src)
+	}
+	buf := copyBuffers.Get()
+	defer copyBuffers.Put(buf)
+	return io.CopyBuffer(onlyWriter{dst}, onlyReader{src}, *buf)
+}
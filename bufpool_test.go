@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+func TestBufferPoolLimit(t *testing.T) {
+	p := NewBufferPool(1024, 16, 2048)
+	a, b := p.Get(), p.Get()
+	if len(*a) != 1024 || len(*b) != 1024 {
+		t.Fatalf("got buffers of %d and %d bytes within limit, want 1024", len(*a), len(*b))
+	}
+	c := p.Get()
+	if len(*c) != 16 {
+		t.Errorf("got buffer of %d bytes beyond limit, want 16", len(*c))
+	}
+	if st := p.Stats(); st.InUse != 2048 {
+		t.Errorf("got %d bytes in use, want 2048", st.InUse)
+	}
+	p.Put(c)
+	p.Put(a)
+	if d := p.Get(); len(*d) != 1024 {
+		t.Errorf("got buffer of %d bytes after release, want 1024", len(*d))
+	}
+	p.Put(b)
+	if st := p.Stats(); st.InUse != 1024 {
+		t.Errorf("got %d bytes in use, want 1024", st.InUse)
+	}
+}
+
+func benchCopyStream(b *testing.B, pair func(testing.TB) (net.Conn, net.Conn)) {
+	payload := make([]byte, benchPayloadSize)
+	b.SetBytes(benchPayloadSize)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		client, src := pair(b)
+		dst, sink := pair(b)
+		b.StartTimer()
+		go func() {
+			client.Write(payload)
+			client.Close()
+		}()
+		go func() {
+			copyStream(dst, src)
+			dst.Close()
+		}()
+		if n, err := io.Copy(io.Discard, sink); err != nil || n != benchPayloadSize {
+			b.Fatalf("copied %d bytes: %v", n, err)
+		}
+		src.Close()
+		sink.Close()
+	}
+}
+
+func BenchmarkCopyStreamTCP(b *testing.B) {
+	benchCopyStream(b, tcpPair)
+}
+
+// Wrapped TCP connections aren't eligible for splice
+func BenchmarkCopyStreamBuffered(b *testing.B) {
+	benchCopyStream(b, func(tb testing.TB) (net.Conn, net.Conn) {
+		left, right := tcpPair(tb)
+		return &bufferedConn{Conn: left}, &bufferedConn{Conn: right}
+	})
+}
+
+func BenchmarkBufferPool(b *testing.B) {
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			copyBuffers.Put(copyBuffers.Get())
+		}
+	})
+}
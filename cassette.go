@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+const MASKED = "MASKED"
+
+// Kind of fallback config exchanges, which are matched on replay regardless
+// of randomly chosen URL
+const CASSETTE_KIND_FALLBACK_CONF = "fallback_conf"
+
+var maskedQueryParams = []string{"uuid", "session_key"}
+var maskedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+var maskedJSONFieldRE = regexp.MustCompile(`("agent_key"\s*:\s*)"[^"]*"`)
+var maskedJSONNumberRE = regexp.MustCompile(`("key"\s*:\s*)-?[0-9]+`)
+
+var apiTransportWrapper = func(rt http.RoundTripper) http.RoundTripper { return rt }
+
+// SetAPITransportWrapper installs wrapper applied to transports of all
+// control plane HTTP clients.
+func SetAPITransportWrapper(wrapper func(http.RoundTripper) http.RoundTripper) {
+	apiTransportWrapper = wrapper
+}
+
+// replayingAPI is set when control plane is served from recordings. Recorded
+// data is not subject to expiration and randomization then.
+var replayingAPI bool
+
+func SetAPIReplay(replay bool) {
+	replayingAPI = replay
+}
+
+type cassetteKindKey struct{}
+
+// withCassetteKind marks requests made with ctx, so they are matched on
+// replay by kind instead of URL.
+func withCassetteKind(ctx context.Context, kind string) context.Context {
+	return context.WithValue(ctx, cassetteKindKey{}, kind)
+}
+
+func cassetteKind(req *http.Request) string {
+	kind, _ := req.Context().Value(cassetteKindKey{}).(string)
+	return kind
+}
+
+type CassetteMessage struct {
+	Method     string      `json:"method,omitempty"`
+	URL        string      `json:"url,omitempty"`
+	Status     int         `json:"status,omitempty"`
+	Header     http.Header `json:"header,omitempty"`
+	Body       string      `json:"body,omitempty"`
+	BodyBase64 bool        `json:"body_base64,omitempty"`
+}
+
+func (m *CassetteMessage) setBody(body []byte) {
+	if utf8.Valid(body) {
+		m.Body = string(body)
+		return
+	}
+	m.Body = base64.StdEncoding.EncodeToString(body)
+	m.BodyBase64 = true
+}
+
+func (m *CassetteMessage) body() ([]byte, error) {
+	if m.BodyBase64 {
+		return base64.StdEncoding.DecodeString(m.Body)
+	}
+	return []byte(m.Body), nil
+}
+
+// CassetteExchange is a single recorded request with its outcome
+type CassetteExchange struct {
+	Kind     string           `json:"kind,omitempty"`
+	Request  CassetteMessage  `json:"request"`
+	Response *CassetteMessage `json:"response,omitempty"`
+	Error    string           `json:"error,omitempty"`
+}
+
+func exchangeKey(kind, method string, u *url.URL) string {
+	if kind != "" {
+		return strings.ToUpper(method) + " " + kind
+	}
+	return strings.ToUpper(method) + " " + u.Scheme + "://" + u.Host + u.Path
+}
+
+func maskBody(body []byte) []byte {
+	body = maskedJSONFieldRE.ReplaceAll(body, []byte(`${1}"`+MASKED+`"`))
+	return maskedJSONNumberRE.ReplaceAll(body, []byte(`${1}0`))
+}
+
+func maskURL(u *url.URL) string {
+	masked := *u
+	q := masked.Query()
+	for _, p := range maskedQueryParams {
+		if q.Has(p) {
+			q.Set(p, MASKED)
+		}
+	}
+	masked.RawQuery = q.Encode()
+	masked.User = nil
+	return masked.String()
+}
+
+func maskHeader(h http.Header) http.Header {
+	res := h.Clone()
+	for _, name := range maskedHeaders {
+		if res.Get(name) != "" {
+			res.Set(name, MASKED)
+		}
+	}
+	return res
+}
+
+// Recorder writes every control plane exchange into directory, one JSON
+// file per exchange, with secrets masked.
+type Recorder struct {
+	dir string
+	mux sync.Mutex
+	seq int
+}
+
+func NewRecorder(dir string) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Recorder{
+		dir: dir,
+	}, nil
+}
+
+func (r *Recorder) Wrap(next http.RoundTripper) http.RoundTripper {
+	return &recordingTransport{
+		recorder: r,
+		next:     next,
+	}
+}
+
+func (r *Recorder) save(ex *CassetteExchange) error {
+	data, err := json.MarshalIndent(ex, "", "  ")
+	if err != nil {
+		return err
+	}
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.seq++
+	return ioutil.WriteFile(filepath.Join(r.dir, fmt.Sprintf("%06d.json", r.seq)), data, 0644)
+}
+
+type recordingTransport struct {
+	recorder *Recorder
+	next     http.RoundTripper
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ex := &CassetteExchange{
+		Kind: cassetteKind(req),
+		Request: CassetteMessage{
+			Method: req.Method,
+			URL:    maskURL(req.URL),
+			Header: maskHeader(req.Header),
+		},
+	}
+	if req.Body != nil && req.Body != http.NoBody {
+		body, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		ex.Request.setBody(body)
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		ex.Error = err.Error()
+		t.recorder.save(ex)
+		return nil, err
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		ex.Error = err.Error()
+		t.recorder.save(ex)
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	ex.Response = &CassetteMessage{
+		Status: resp.StatusCode,
+		Header: maskHeader(resp.Header),
+	}
+	ex.Response.setBody(maskBody(body))
+	if err := t.recorder.save(ex); err != nil {
+		return nil, fmt.Errorf("unable to record exchange: %w", err)
+	}
+	return resp, nil
+}
+
+// Replayer serves recorded exchanges back without any network activity.
+// Requests are matched by method, host and path, or by method and kind for
+// requests with randomly chosen URL; exchanges with the same key are served
+// in recorded order.
+type Replayer struct {
+	mux    sync.Mutex
+	queues map[string][]*CassetteExchange
+}
+
+func LoadReplayer(dir string) (*Replayer, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no recorded exchanges found in %s", dir)
+	}
+	sort.Strings(files)
+	r := &Replayer{
+		queues: make(map[string][]*CassetteExchange),
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		ex := &CassetteExchange{}
+		if err := json.Unmarshal(data, ex); err != nil {
+			return nil, fmt.Errorf("unable to parse %s: %w", file, err)
+		}
+		u, err := url.Parse(ex.Request.URL)
+		if err != nil {
+			return nil, fmt.Errorf("bad URL in %s: %w", file, err)
+		}
+		key := exchangeKey(ex.Kind, ex.Request.Method, u)
+		r.queues[key] = append(r.queues[key], ex)
+	}
+	return r, nil
+}
+
+func (r *Replayer) Wrap(_ http.RoundTripper) http.RoundTripper {
+	return r
+}
+
+func (r *Replayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	key := exchangeKey(cassetteKind(req), req.Method, req.URL)
+	r.mux.Lock()
+	queue := r.queues[key]
+	if len(queue) == 0 {
+		r.mux.Unlock()
+		return nil, fmt.Errorf("replay: no more recorded exchanges for %s", key)
+	}
+	ex := queue[0]
+	r.queues[key] = queue[1:]
+	r.mux.Unlock()
+
+	if ex.Error != "" {
+		return nil, errors.New(ex.Error)
+	}
+	if ex.Response == nil {
+		return nil, fmt.Errorf("replay: exchange for %s has no response", key)
+	}
+	body, err := ex.Response.body()
+	if err != nil {
+		return nil, fmt.Errorf("replay: bad body of recorded response for %s: %w", key, err)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", ex.Response.Status, http.StatusText(ex.Response.Status)),
+		StatusCode:    ex.Response.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        ex.Response.Header,
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
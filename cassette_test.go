@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func useAPITransportWrapper(t *testing.T, wrapper func(http.RoundTripper) http.RoundTripper) {
+	old := apiTransportWrapper
+	t.Cleanup(func() {
+		SetAPITransportWrapper(old)
+	})
+	SetAPITransportWrapper(wrapper)
+}
+
+func useAPIReplay(t *testing.T, replayer *Replayer) {
+	useAPITransportWrapper(t, replayer.Wrap)
+	t.Cleanup(func() {
+		SetAPIReplay(false)
+	})
+	SetAPIReplay(true)
+}
+
+func TestCassetteRecordReplay(t *testing.T) {
+	env := newTestEnv(t)
+	dir := t.TempDir()
+	recorder, err := NewRecorder(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	useAPITransportWrapper(t, recorder.Wrap)
+
+	logger := testLogger(t, "CRED    : ")
+	bootstrap := func() (*ZGetTunnelsResponse, error) {
+		tunnels, _, err := Tunnels(context.Background(), logger, httpClientWithProxy(nil), "1.0", "us", "direct",
+			DEFAULT_LIST_LIMIT, 5*time.Second, time.Millisecond, 50*time.Millisecond)
+		return tunnels, err
+	}
+	recorded, err := bootstrap()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	if len(files) != 2 {
+		t.Fatalf("got %d recorded exchanges, want 2", len(files))
+	}
+	for _, file := range files {
+		data, _ := ioutil.ReadFile(file)
+		if strings.Contains(string(data), recorded.AgentKey) {
+			t.Errorf("%s contains unmasked agent key", file)
+		}
+		if strings.Contains(string(data), "12345") {
+			t.Errorf("%s contains unmasked session key", file)
+		}
+	}
+
+	env.api.Close()
+	replayer, err := LoadReplayer(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	useAPIReplay(t, replayer)
+	replayed, err := bootstrap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayed.AgentKey != MASKED {
+		t.Errorf("got agent key %q, want %q", replayed.AgentKey, MASKED)
+	}
+	if len(replayed.IPList) != len(recorded.IPList) {
+		t.Errorf("replayed tunnels differ: %v vs %v", replayed.IPList, recorded.IPList)
+	}
+	if _, err := bootstrap(); err == nil {
+		t.Error("exhausted cassette served a response")
+	}
+}
+
+func TestCassetteReplayFallback(t *testing.T) {
+	env := newTestEnv(t)
+	apiAddr := env.api.Listener.Addr().String()
+	// Direct connections to API fail, so fallback agent is the only way.
+	setupHolaGlobals(t, env.pki, env.api.URL, dialerFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+		if address == apiAddr {
+			return nil, errors.New("connection refused by test")
+		}
+		return (&net.Dialer{}).DialContext(ctx, network, address)
+	}))
+	const confTTL = 200 * time.Millisecond
+	conf := newFakeFallbackConfServerTTL(t, env.pki, env.fallbackAgents("zagent2"), confTTL)
+	FALLBACK_CONF_URLS = []string{conf.URL + "/cloud_failover.conf"}
+
+	dir := t.TempDir()
+	recorder, err := NewRecorder(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	useAPITransportWrapper(t, recorder.Wrap)
+
+	logger := testLogger(t, "CRED    : ")
+	bootstrap := func() (*ZGetTunnelsResponse, error) {
+		var (
+			tunnels *ZGetTunnelsResponse
+			err     error
+		)
+		ok, txErr := EnsureTransaction(context.Background(), 5*time.Second, func(ctx context.Context, client *http.Client) bool {
+			tunnels, _, err = Tunnels(ctx, logger, client, "1.0", "us", "direct",
+				DEFAULT_LIST_LIMIT, 5*time.Second, time.Millisecond, 50*time.Millisecond)
+			return err == nil
+		})
+		if txErr != nil {
+			return nil, txErr
+		}
+		if !ok {
+			return nil, err
+		}
+		return tunnels, nil
+	}
+	if _, err := bootstrap(); err != nil {
+		t.Fatal(err)
+	}
+	if env.agent.connects.Load() == 0 {
+		t.Fatal("fallback agent was not used")
+	}
+
+	// Replay works offline, with recorded fallback config expired and
+	// fallback config URLs chosen differently.
+	env.api.Close()
+	conf.Close()
+	time.Sleep(2 * confTTL)
+	fbcMux.Lock()
+	cachedFBC = nil
+	fbcMux.Unlock()
+	FALLBACK_CONF_URLS = []string{"https://fallback.invalid/a.conf", "https://fallback.invalid/b.conf"}
+	replayer, err := LoadReplayer(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	useAPIReplay(t, replayer)
+	replayed, err := bootstrap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayed.AgentKey != MASKED {
+		t.Errorf("got agent key %q, want %q", replayed.AgentKey, MASKED)
+	}
+}
@@ -35,7 +35,7 @@ func GetChromeVer(ctx context.Context, dialer ContextDialer) (string, error) {
 	}
 	defer transport.CloseIdleConnections()
 	httpClient := &http.Client{
-		Transport: transport,
+		Transport: apiTransportWrapper(transport),
 	}
 
 	req, err := http.NewRequestWithContext(ctx, "GET", chromeVerURL, nil)
@@ -2,85 +2,376 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const DEFAULT_LIST_LIMIT = 3
+const IDENTITY_REFRESH_RETRY = 30 * time.Second
 
-func CredService(interval, timeout time.Duration,
+var NoIdentitiesError = errors.New("no usable identities in pool")
+
+// UpstreamFactory builds upstream for freshly obtained tunnels and credentials
+type UpstreamFactory func(name string, tunnels *ZGetTunnelsResponse, auth AuthProvider) (*Upstream, error)
+
+// Identity is a single independently bootstrapped Hola user
+type Identity struct {
+	id         int
+	generation int
+	mux        sync.RWMutex
+	userUUID   string
+	tunnels    *ZGetTunnelsResponse
+	upstream   *Upstream
+	retired    bool
+	refresh    chan struct{}
+	// agent is the endpoint last connection of identity went through
+	agent atomic.Pointer[Endpoint]
+}
+
+func (i *Identity) ID() int {
+	return i.id
+}
+
+func (i *Identity) Upstream() *Upstream {
+	i.mux.RLock()
+	defer i.mux.RUnlock()
+	return i.upstream
+}
+
+func (i *Identity) Retired() bool {
+	i.mux.RLock()
+	defer i.mux.RUnlock()
+	return i.retired || i.upstream == nil
+}
+
+type IdentityPool struct {
+	ctx             context.Context
+	cancel          context.CancelFunc
+	wg              sync.WaitGroup
+	identities      []*Identity
+	policy          IdentityPolicy
+	bans            *BanMonitor
+	logger          *CondLogger
+	factory         UpstreamFactory
+	interval        time.Duration
+	timeout         time.Duration
+	extVer          string
+	country         string
+	proxytype       string
+	backoffInitial  time.Duration
+	backoffDeadline time.Duration
+}
+
+// CredService bootstraps pool of poolSize identities and keeps their
+// credentials rotated once per interval. Banned identities are retired from
+// selection and replaced with new ones in background.
+func CredService(poolSize int,
+	policy IdentityPolicy,
+	bans *BanMonitor,
+	interval, timeout time.Duration,
 	extVer string,
 	country string,
 	proxytype string,
 	logger *CondLogger,
 	backoffInitial time.Duration,
 	backoffDeadline time.Duration,
-) (auth AuthProvider, tunnels *ZGetTunnelsResponse, err error) {
-	var mux sync.Mutex
-	var auth_header, user_uuid string
-	auth = func() (res string) {
-		mux.Lock()
-		defer mux.Unlock()
-		return auth_header
-	}
-
-	tx_res, tx_err := EnsureTransaction(context.Background(), timeout, func(ctx context.Context, client *http.Client) bool {
-		tunnels, user_uuid, err = Tunnels(ctx, logger, client, extVer, country, proxytype,
-			DEFAULT_LIST_LIMIT, timeout, backoffInitial, backoffDeadline)
+	factory UpstreamFactory,
+) (*IdentityPool, error) {
+	if poolSize < 1 {
+		poolSize = 1
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &IdentityPool{
+		ctx:             ctx,
+		cancel:          cancel,
+		identities:      make([]*Identity, poolSize),
+		policy:          policy,
+		bans:            bans,
+		logger:          logger,
+		factory:         factory,
+		interval:        interval,
+		timeout:         timeout,
+		extVer:          extVer,
+		country:         country,
+		proxytype:       proxytype,
+		backoffInitial:  backoffInitial,
+		backoffDeadline: backoffDeadline,
+	}
+
+	errs := make([]error, poolSize)
+	var wg sync.WaitGroup
+	for i := range p.identities {
+		p.identities[i] = &Identity{
+			id:      i,
+			refresh: make(chan struct{}, 1),
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = p.bootstrap(p.identities[i])
+		}(i)
+	}
+	wg.Wait()
+
+	var lastErr error
+	ok := 0
+	for i, err := range errs {
 		if err != nil {
-			logger.Error("Configuration bootstrap error: %v. Retrying with the fallback mechanism...", err)
-			return false
+			logger.Error("Identity #%d bootstrap failed: %v", i, err)
+			lastErr = err
+			continue
 		}
-		return true
+		ok++
+	}
+	if ok == 0 {
+		cancel()
+		logger.Critical("All attempts failed.")
+		return nil, lastErr
+	}
+	logger.Info("Bootstrapped %d of %d identities.", ok, poolSize)
+
+	for i, ident := range p.identities {
+		if errs[i] != nil {
+			ident.refresh <- struct{}{}
+		}
+		p.wg.Add(1)
+		go p.maintain(ident)
+	}
+	return p, nil
+}
+
+// Close stops credential rotation and waits for background tasks to finish.
+func (p *IdentityPool) Close() {
+	p.cancel()
+	p.wg.Wait()
+}
+
+func (p *IdentityPool) bootstrap(ident *Identity) error {
+	var (
+		tunnels   *ZGetTunnelsResponse
+		user_uuid string
+		err       error
+	)
+	if err := p.bans.Wait(p.ctx, ident.id); err != nil {
+		return err
+	}
+	tx_res, tx_err := EnsureTransaction(p.ctx, p.timeout, func(ctx context.Context, client *http.Client) bool {
+		// Every attempt gets new user ID, so permanently banned one is
+		// never reused.
+		tunnels, user_uuid, err = Tunnels(ctx, p.logger, client, p.extVer, p.country, p.proxytype,
+			DEFAULT_LIST_LIMIT, p.timeout, p.backoffInitial, p.backoffDeadline)
+		if err == nil {
+			return true
+		}
+		if p.bans.Report(ident.id, err) {
+			// Other fallback agents won't help with ban. Abort transaction
+			// and let caller retry after cooldown.
+			if agent := FallbackAgentFromContext(ctx); agent != nil && errors.Is(err, PermanentBanError) {
+				DropFallbackAgent(agent)
+				p.logger.Warning("Fallback agent %s is dropped after permanent ban.", agent.Hostname())
+				events.Emit(EVENT_FALLBACK_DROPPED, map[string]string{
+					"agent": agent.Hostname(),
+					"ip":    agent.IP,
+				})
+			}
+			return true
+		}
+		p.logger.Error("Identity #%d configuration bootstrap error: %v. Retrying with the fallback mechanism...",
+			ident.id, err)
+		return false
 	})
 	if tx_err != nil {
-		logger.Critical("Transaction recovery mechanism failure: %v", tx_err)
-		err = tx_err
-		return
+		p.logger.Critical("Transaction recovery mechanism failure: %v", tx_err)
+		return tx_err
+	}
+	if err != nil {
+		return err
 	}
 	if !tx_res {
-		logger.Critical("All attempts failed.")
-		return
+		return errors.New("all fallback proxies failed")
 	}
-	auth_header = basic_auth_header(TemplateLogin(user_uuid), tunnels.AgentKey)
-	if interval <= 0 {
-		return
+
+	p.bans.Reset(ident.id)
+
+	authHeader := basic_auth_header(TemplateLogin(user_uuid), tunnels.AgentKey)
+	ident.mux.Lock()
+	defer ident.mux.Unlock()
+	up, err := p.factory(fmt.Sprintf("identity-%d-%d", ident.id, ident.generation),
+		tunnels,
+		func() string {
+			return authHeader
+		})
+	if err != nil {
+		return err
+	}
+	up.Dialer = &identityDialer{
+		next:  up.Dialer,
+		pool:  p,
+		ident: ident,
+		up:    up,
 	}
-	go func() {
-		var (
-			err       error
-			tuns      *ZGetTunnelsResponse
-			user_uuid string
-		)
-		ticker := time.NewTicker(interval)
+	ident.generation++
+	ident.userUUID = user_uuid
+	ident.tunnels = tunnels
+	ident.upstream = up
+	ident.retired = false
+
+	events.Emit(EVENT_CREDENTIALS_ROTATED, map[string]string{
+		"identity": strconv.Itoa(ident.id),
+		"name":     up.Name,
+	})
+	return nil
+}
+
+func (p *IdentityPool) maintain(ident *Identity) {
+	defer p.wg.Done()
+	var rotate <-chan time.Time
+	if p.interval > 0 {
+		ticker := time.NewTicker(p.interval)
 		defer ticker.Stop()
+		rotate = ticker.C
+	}
+	for {
+		select {
+		case <-rotate:
+			p.logger.Info("Rotating credentials of identity #%d...", ident.id)
+		case <-ident.refresh:
+			p.logger.Info("Replacing retired identity #%d...", ident.id)
+		case <-p.ctx.Done():
+			return
+		}
 		for {
-			<-ticker.C
-			logger.Info("Rotating credentials...")
-			tx_res, tx_err := EnsureTransaction(context.Background(), timeout, func(ctx context.Context, client *http.Client) bool {
-				tuns, user_uuid, err = Tunnels(ctx, logger, client, extVer, country, proxytype,
-					DEFAULT_LIST_LIMIT, timeout, backoffInitial, backoffDeadline)
-				if err != nil {
-					logger.Error("Credential rotation error: %v. Retrying with the fallback mechanism...", err)
-					return false
-				}
-				return true
-			})
-			if tx_err != nil {
-				logger.Critical("Transaction recovery mechanism failure: %v", tx_err)
-				err = tx_err
-				continue
+			err := p.bootstrap(ident)
+			if err == nil {
+				p.logger.Info("Credentials of identity #%d rotated successfully.", ident.id)
+				break
 			}
-			if !tx_res {
-				logger.Critical("All rotation attempts failed.")
-				continue
+			if !ident.Retired() {
+				p.logger.Error("Credential rotation of identity #%d failed: %v", ident.id, err)
+				break
 			}
-			mux.Lock()
-			auth_header = basic_auth_header(TemplateLogin(user_uuid), tuns.AgentKey)
-			mux.Unlock()
-			logger.Info("Credentials rotated successfully.")
+			p.logger.Error("Identity #%d replacement failed: %v. Retrying in %v...",
+				ident.id, err, IDENTITY_REFRESH_RETRY)
+			select {
+			case <-time.After(IDENTITY_REFRESH_RETRY):
+			case <-p.ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// Retire excludes identity from selection and schedules its replacement
+// unless upstream was already superseded by rotation.
+func (p *IdentityPool) Retire(ident *Identity, up *Upstream) {
+	ident.mux.Lock()
+	if ident.upstream != up || ident.retired {
+		ident.mux.Unlock()
+		return
+	}
+	ident.retired = true
+	ident.mux.Unlock()
+	p.logger.Warning("Identity #%d (%s) is banned by upstream. Retiring it.", ident.id, up.Name)
+	events.Emit(EVENT_IDENTITY_RETIRED, map[string]string{
+		"identity": strconv.Itoa(ident.id),
+		"name":     up.Name,
+	})
+	select {
+	case ident.refresh <- struct{}{}:
+	default:
+	}
+}
+
+func (p *IdentityPool) Alive() []*Identity {
+	res := make([]*Identity, 0, len(p.identities))
+	for _, ident := range p.identities {
+		if !ident.Retired() {
+			res = append(res, ident)
+		}
+	}
+	return res
+}
+
+type IdentityStatus struct {
+	ID       int    `json:"id"`
+	Name     string `json:"name,omitempty"`
+	Endpoint string `json:"endpoint,omitempty"`
+	Retired  bool   `json:"retired"`
+}
+
+func (p *IdentityPool) Status() []IdentityStatus {
+	res := make([]IdentityStatus, 0, len(p.identities))
+	for _, ident := range p.identities {
+		st := IdentityStatus{
+			ID:      ident.id,
+			Retired: ident.Retired(),
+		}
+		if up := ident.Upstream(); up != nil {
+			st.Name = up.Name
+			st.Endpoint = up.Endpoint.URL().String()
 		}
-	}()
-	return
+		res = append(res, st)
+	}
+	return res
+}
+
+func (p *IdentityPool) SelectUpstream(req *http.Request) (*Upstream, error) {
+	alive := p.Alive()
+	if len(alive) == 0 {
+		return nil, NoIdentitiesError
+	}
+	up := p.policy(req, alive).Upstream()
+	if up == nil {
+		return nil, NoIdentitiesError
+	}
+	return up, nil
+}
+
+// identityDialer reports rejected credentials back to the pool
+type identityDialer struct {
+	next  ContextDialer
+	pool  *IdentityPool
+	ident *Identity
+	up    *Upstream
+}
+
+func (d *identityDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := d.next.DialContext(ctx, network, address)
+	if errors.Is(err, UpstreamAuthError) {
+		d.pool.Retire(d.ident, d.up)
+	}
+	if err == nil || errors.Is(err, UpstreamBlockedError) {
+		d.agentUsed()
+	}
+	return conn, err
+}
+
+// agentUsed notifies when traffic of identity moves to another agent.
+func (d *identityDialer) agentUsed() {
+	prev := d.ident.agent.Load()
+	if prev != nil && *prev == *d.up.Endpoint {
+		return
+	}
+	if !d.ident.agent.CompareAndSwap(prev, d.up.Endpoint) {
+		return
+	}
+	data := map[string]string{
+		"identity": strconv.Itoa(d.ident.id),
+		"name":     d.up.Name,
+		"endpoint": d.up.Endpoint.URL().String(),
+	}
+	if prev != nil {
+		data["previous_endpoint"] = prev.URL().String()
+	}
+	events.Emit(EVENT_AGENT_CHANGED, data)
+}
+
+func (d *identityDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
 }
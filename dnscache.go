@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DEFAULT_DNS_CACHE_SIZE        = 1024
+	DEFAULT_DNS_MIN_TTL           = 1 * time.Minute
+	DEFAULT_DNS_MAX_TTL           = 1 * time.Hour
+	DEFAULT_DNS_NEGATIVE_TTL      = 1 * time.Minute
+	DNS_PREFETCH_MIN_HITS         = 3
+	DNS_PREFETCH_REMAINING        = 0.1
+	DNS_BACKGROUND_LOOKUP_TIMEOUT = 30 * time.Second
+)
+
+type DNSCacheConfig struct {
+	Size int
+	// Positive answers are kept for their TTL clamped to [MinTTL, MaxTTL].
+	// Answers without known TTL are kept for MinTTL.
+	MinTTL time.Duration
+	MaxTTL time.Duration
+	// Negative answers are kept for their TTL, but no longer than
+	// NegativeTTL.
+	NegativeTTL time.Duration
+	// Refresh entries requested frequently before they expire
+	Prefetch bool
+}
+
+type DNSCacheStats struct {
+	Entries      int    `json:"entries"`
+	Hits         uint64 `json:"hits"`
+	NegativeHits uint64 `json:"negative_hits"`
+	Misses       uint64 `json:"misses"`
+	Shared       uint64 `json:"shared"`
+	Prefetches   uint64 `json:"prefetches"`
+}
+
+type dnsCacheKey struct {
+	network string
+	host    string
+}
+
+type dnsCacheEntry struct {
+	addrs   []netip.Addr
+	err     error
+	ttl     time.Duration
+	expires time.Time
+	// when TTL reported by upstream runs out, zero if it is unknown
+	upstreamExpires time.Time
+	hits            int
+	prefetched      bool
+}
+
+// reportedTTL returns TTL of cached answer for callers: remaining upstream
+// TTL, but no longer than answer stays cached. So lifetime extended with
+// MinTTL doesn't propagate further. Zero means TTL is unknown.
+func (e *dnsCacheEntry) reportedTTL(now time.Time) time.Duration {
+	if e.upstreamExpires.IsZero() {
+		return 0
+	}
+	return max(min(e.upstreamExpires.Sub(now), e.expires.Sub(now)), time.Second)
+}
+
+// dnsFlight is lookup in progress shared by concurrent callers
+type dnsFlight struct {
+	done  chan struct{}
+	addrs []netip.Addr
+	ttl   time.Duration
+	err   error
+}
+
+// CachingResolver caches answers of wrapped resolver. Concurrent lookups
+// of the same name are merged into one.
+type CachingResolver struct {
+	next    LookupNetIPer
+	cfg     DNSCacheConfig
+	mux     sync.Mutex
+	entries map[dnsCacheKey]*dnsCacheEntry
+	flights map[dnsCacheKey]*dnsFlight
+
+	hits         atomic.Uint64
+	negativeHits atomic.Uint64
+	misses       atomic.Uint64
+	shared       atomic.Uint64
+	prefetches   atomic.Uint64
+}
+
+func NewCachingResolver(next LookupNetIPer, cfg DNSCacheConfig) *CachingResolver {
+	return &CachingResolver{
+		next:    next,
+		cfg:     cfg,
+		entries: make(map[dnsCacheKey]*dnsCacheEntry),
+		flights: make(map[dnsCacheKey]*dnsFlight),
+	}
+}
+
+func (r *CachingResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	addrs, _, err := r.LookupNetIPTTL(ctx, network, host)
+	return addrs, err
+}
+
+// LookupNetIPTTL resolves host, reporting remaining upstream TTL of cached
+// answer, limited by its remaining lifetime in cache
+func (r *CachingResolver) LookupNetIPTTL(ctx context.Context, network, host string) ([]netip.Addr, time.Duration, error) {
+	if _, err := netip.ParseAddr(host); err == nil {
+		return lookupTTL(ctx, r.next, network, host)
+	}
+	key := dnsCacheKey{network, normalizeHost(host)}
+	now := time.Now()
+
+	r.mux.Lock()
+	if entry, ok := r.entries[key]; ok {
+		if now.Before(entry.expires) {
+			entry.hits++
+			prefetch := r.cfg.Prefetch && entry.err == nil && !entry.prefetched &&
+				entry.hits >= DNS_PREFETCH_MIN_HITS &&
+				entry.expires.Sub(now) < time.Duration(float64(entry.ttl)*DNS_PREFETCH_REMAINING)
+			if prefetch {
+				entry.prefetched = true
+			}
+			addrs, err, ttl := entry.addrs, entry.err, entry.reportedTTL(now)
+			r.mux.Unlock()
+			if prefetch {
+				r.prefetches.Add(1)
+				r.startFlight(key)
+			}
+			if err != nil {
+				r.negativeHits.Add(1)
+				return nil, ttl, err
+			}
+			r.hits.Add(1)
+			return slices.Clone(addrs), ttl, nil
+		}
+		delete(r.entries, key)
+	}
+	r.mux.Unlock()
+	r.misses.Add(1)
+
+	flight := r.startFlight(key)
+	select {
+	case <-flight.done:
+		if flight.err != nil {
+			return nil, flight.ttl, flight.err
+		}
+		return slices.Clone(flight.addrs), flight.ttl, nil
+	case <-ctx.Done():
+		return nil, 0, ctx.Err()
+	}
+}
+
+// startFlight joins lookup in progress or starts new one in background.
+// Lookup is not bound to context of any caller, so early cancellation of
+// one caller does not fail others.
+func (r *CachingResolver) startFlight(key dnsCacheKey) *dnsFlight {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if flight, ok := r.flights[key]; ok {
+		r.shared.Add(1)
+		return flight
+	}
+	flight := &dnsFlight{
+		done: make(chan struct{}),
+	}
+	r.flights[key] = flight
+	go func() {
+		ctx, cl := context.WithTimeout(context.Background(), DNS_BACKGROUND_LOOKUP_TIMEOUT)
+		defer cl()
+		addrs, ttl, err := lookupTTL(ctx, r.next, key.network, key.host)
+		r.mux.Lock()
+		delete(r.flights, key)
+		flight.addrs, flight.ttl, flight.err = addrs, r.store(key, addrs, ttl, err), err
+		r.mux.Unlock()
+		close(flight.done)
+	}()
+	return flight
+}
+
+// store saves lookup result and returns TTL to report for it. Has to be
+// called with lock held.
+func (r *CachingResolver) store(key dnsCacheKey, addrs []netip.Addr, ttl time.Duration, err error) time.Duration {
+	if r.cfg.Size <= 0 {
+		return ttl
+	}
+	upstreamTTL := ttl
+	if err != nil {
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			// Don't cache transient failures
+			return 0
+		}
+		if ttl <= 0 || ttl > r.cfg.NegativeTTL {
+			ttl = r.cfg.NegativeTTL
+		}
+		addrs = nil
+	} else {
+		if ttl < r.cfg.MinTTL {
+			ttl = r.cfg.MinTTL
+		}
+		if ttl > r.cfg.MaxTTL {
+			ttl = r.cfg.MaxTTL
+		}
+	}
+	if ttl <= 0 {
+		return 0
+	}
+	now := time.Now()
+	if _, ok := r.entries[key]; !ok && len(r.entries) >= r.cfg.Size {
+		r.evict(now)
+	}
+	entry := &dnsCacheEntry{
+		addrs:   addrs,
+		err:     err,
+		ttl:     ttl,
+		expires: now.Add(ttl),
+	}
+	if upstreamTTL > 0 {
+		entry.upstreamExpires = now.Add(upstreamTTL)
+	}
+	r.entries[key] = entry
+	return entry.reportedTTL(now)
+}
+
+// evict drops expired entries or, if there are none, entry closest to
+// expiration. Has to be called with lock held.
+func (r *CachingResolver) evict(now time.Time) {
+	var (
+		oldest      dnsCacheKey
+		oldestEntry *dnsCacheEntry
+	)
+	for key, entry := range r.entries {
+		if !now.Before(entry.expires) {
+			delete(r.entries, key)
+			continue
+		}
+		if oldestEntry == nil || entry.expires.Before(oldestEntry.expires) {
+			oldest, oldestEntry = key, entry
+		}
+	}
+	if len(r.entries) >= r.cfg.Size && oldestEntry != nil {
+		delete(r.entries, oldest)
+	}
+}
+
+func (r *CachingResolver) Stats() DNSCacheStats {
+	r.mux.Lock()
+	entries := len(r.entries)
+	r.mux.Unlock()
+	return DNSCacheStats{
+		Entries:      entries,
+		Hits:         r.hits.Load(),
+		NegativeHits: r.negativeHits.Load(),
+		Misses:       r.misses.Load(),
+		Shared:       r.shared.Load(),
+		Prefetches:   r.prefetches.Load(),
+	}
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"context"
+	stdtls "crypto/tls"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// countingResolver answers from static records with fixed TTL
+type countingResolver struct {
+	records map[string][]netip.Addr
+	ttl     time.Duration
+	delay   time.Duration
+	err     error
+	calls   atomic.Int64
+}
+
+func (r *countingResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	addrs, _, err := r.LookupNetIPTTL(ctx, network, host)
+	return addrs, err
+}
+
+func (r *countingResolver) LookupNetIPTTL(ctx context.Context, network, host string) ([]netip.Addr, time.Duration, error) {
+	r.calls.Add(1)
+	select {
+	case <-time.After(r.delay):
+	case <-ctx.Done():
+		return nil, 0, ctx.Err()
+	}
+	if r.err != nil {
+		return nil, 0, r.err
+	}
+	addrs, ok := r.records[host]
+	if !ok {
+		return nil, r.ttl, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return addrs, r.ttl, nil
+}
+
+func testDNSCacheConfig() DNSCacheConfig {
+	return DNSCacheConfig{
+		Size:        10,
+		MinTTL:      time.Millisecond,
+		MaxTTL:      time.Hour,
+		NegativeTTL: time.Hour,
+	}
+}
+
+func TestCachingResolver(t *testing.T) {
+	next := &countingResolver{
+		records: map[string][]netip.Addr{"example.test": {netip.MustParseAddr("192.0.2.1")}},
+		ttl:     time.Hour,
+	}
+	r := NewCachingResolver(next, testDNSCacheConfig())
+	for i := 0; i < 3; i++ {
+		addrs, err := r.LookupNetIP(context.Background(), "ip", "example.test")
+		if err != nil || len(addrs) != 1 {
+			t.Fatalf("got %v, %v", addrs, err)
+		}
+		_, err = r.LookupNetIP(context.Background(), "ip", "missing.test")
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			t.Fatalf("got error %v, want not found", err)
+		}
+	}
+	if calls := next.calls.Load(); calls != 2 {
+		t.Errorf("upstream resolver called %d times, want 2", calls)
+	}
+	stats := r.Stats()
+	if stats.Hits != 2 || stats.NegativeHits != 2 || stats.Misses != 2 || stats.Entries != 2 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestCachingResolverTTLClamp(t *testing.T) {
+	next := &countingResolver{
+		records: map[string][]netip.Addr{"example.test": {netip.MustParseAddr("192.0.2.1")}},
+		ttl:     time.Hour,
+	}
+	cfg := testDNSCacheConfig()
+	cfg.MaxTTL = 50 * time.Millisecond
+	r := NewCachingResolver(next, cfg)
+	r.LookupNetIP(context.Background(), "ip", "example.test")
+	r.LookupNetIP(context.Background(), "ip", "example.test")
+	time.Sleep(100 * time.Millisecond)
+	r.LookupNetIP(context.Background(), "ip", "example.test")
+	if calls := next.calls.Load(); calls != 2 {
+		t.Errorf("upstream resolver called %d times, want 2", calls)
+	}
+}
+
+func TestCachingResolverRemainingTTL(t *testing.T) {
+	next := &countingResolver{
+		records: map[string][]netip.Addr{"example.test": {netip.MustParseAddr("192.0.2.1")}},
+		ttl:     time.Hour,
+	}
+	cfg := testDNSCacheConfig()
+	cfg.MaxTTL = time.Minute
+	r := NewCachingResolver(next, cfg)
+	_, ttl, err := r.LookupNetIPTTL(context.Background(), "ip", "example.test")
+	if err != nil || ttl != time.Minute {
+		t.Fatalf("got TTL %v, %v; want %v", ttl, err, time.Minute)
+	}
+	time.Sleep(10 * time.Millisecond)
+	_, ttl, err = r.LookupNetIPTTL(context.Background(), "ip", "example.test")
+	if err != nil || ttl >= time.Minute || ttl < time.Minute-time.Second {
+		t.Errorf("got TTL %v, %v; want remaining lifetime of cached answer", ttl, err)
+	}
+}
+
+func TestCachingResolverUpstreamTTL(t *testing.T) {
+	next := &countingResolver{
+		records: map[string][]netip.Addr{"example.test": {netip.MustParseAddr("192.0.2.1")}},
+		ttl:     5 * time.Second,
+	}
+	cfg := testDNSCacheConfig()
+	cfg.MinTTL = time.Minute
+	r := NewCachingResolver(next, cfg)
+	// TTL raised by MinTTL extends caching only and is not reported
+	for i := 0; i < 2; i++ {
+		_, ttl, err := r.LookupNetIPTTL(context.Background(), "ip", "example.test")
+		if err != nil || ttl > 5*time.Second || ttl < 4*time.Second {
+			t.Errorf("got TTL %v, %v; want upstream TTL", ttl, err)
+		}
+	}
+	if calls := next.calls.Load(); calls != 1 {
+		t.Errorf("upstream resolver called %d times, want 1", calls)
+	}
+
+	next.ttl = 0
+	_, ttl, err := NewCachingResolver(next, cfg).LookupNetIPTTL(context.Background(), "ip", "example.test")
+	if err != nil || ttl != 0 {
+		t.Errorf("got TTL %v, %v; want unknown TTL", ttl, err)
+	}
+}
+
+func TestCachingResolverSingleflight(t *testing.T) {
+	next := &countingResolver{
+		records: map[string][]netip.Addr{"example.test": {netip.MustParseAddr("192.0.2.1")}},
+		ttl:     time.Hour,
+		delay:   50 * time.Millisecond,
+	}
+	r := NewCachingResolver(next, testDNSCacheConfig())
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := r.LookupNetIP(context.Background(), "ip", "example.test"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if calls := next.calls.Load(); calls != 1 {
+		t.Errorf("upstream resolver called %d times, want 1", calls)
+	}
+}
+
+func TestCachingResolverPrefetch(t *testing.T) {
+	next := &countingResolver{
+		records: map[string][]netip.Addr{"example.test": {netip.MustParseAddr("192.0.2.1")}},
+		ttl:     time.Second,
+	}
+	cfg := testDNSCacheConfig()
+	cfg.Prefetch = true
+	r := NewCachingResolver(next, cfg)
+	r.LookupNetIP(context.Background(), "ip", "example.test")
+	time.Sleep(920 * time.Millisecond)
+	for i := 0; i < DNS_PREFETCH_MIN_HITS; i++ {
+		r.LookupNetIP(context.Background(), "ip", "example.test")
+	}
+	deadline := time.Now().Add(time.Second)
+	for next.calls.Load() < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if r.Stats().Prefetches != 1 || next.calls.Load() != 2 {
+		t.Fatalf("hot entry is not prefetched: %+v", r.Stats())
+	}
+}
+
+func TestMessageResolver(t *testing.T) {
+	pki := newTestPKI(t)
+	doh := newFakeDoH(t, pki, map[string][]netip.Addr{
+		"example.test": {netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("2001:db8::1")},
+	})
+	r := doh.Resolver(t, pki)
+	addrs, ttl, err := r.LookupNetIPTTL(context.Background(), "ip", "example.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 2 || ttl != 60*time.Second {
+		t.Errorf("got %v with TTL %v", addrs, ttl)
+	}
+	_, _, err = r.LookupNetIPTTL(context.Background(), "ip4", "missing.test")
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Errorf("got error %v, want not found", err)
+	}
+}
+
+func TestParseAddrResponseNegativeTTL(t *testing.T) {
+	name := dnsmessage.MustNewName("missing.test.")
+	resp, err := (&dnsmessage.Message{
+		Header: dnsmessage.Header{ID: 1, Response: true, RCode: dnsmessage.RCodeNameError},
+		Questions: []dnsmessage.Question{{
+			Name:  name,
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+		}},
+		Authorities: []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{
+				Name:  dnsmessage.MustNewName("test."),
+				Type:  dnsmessage.TypeSOA,
+				Class: dnsmessage.ClassINET,
+				TTL:   300,
+			},
+			Body: &dnsmessage.SOAResource{
+				NS:     dnsmessage.MustNewName("ns.test."),
+				MBox:   dnsmessage.MustNewName("admin.test."),
+				MinTTL: 120,
+			},
+		}},
+	}).Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ttl, err := parseAddrResponse(resp, "missing.test", 1, dnsmessage.Question{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET})
+	if err == nil || ttl != 120*time.Second {
+		t.Errorf("got TTL %v, error %v", ttl, err)
+	}
+}
+
+func TestParseAddrResponseFiltering(t *testing.T) {
+	q := dnsmessage.Question{
+		Name:  dnsmessage.MustNewName("www.test."),
+		Type:  dnsmessage.TypeA,
+		Class: dnsmessage.ClassINET,
+	}
+	rr := func(name string, class dnsmessage.Class, ttl uint32, body dnsmessage.ResourceBody) dnsmessage.Resource {
+		return dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{
+				Name:  dnsmessage.MustNewName(name),
+				Class: class,
+				TTL:   ttl,
+			},
+			Body: body,
+		}
+	}
+	pack := func(answers ...dnsmessage.Resource) []byte {
+		resp, err := (&dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: 1, Response: true},
+			Questions: []dnsmessage.Question{q},
+			Answers:   answers,
+		}).Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	cname := rr("WWW.test.", dnsmessage.ClassINET, 30, &dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName("web.test.")})
+	foreign := []dnsmessage.Resource{
+		rr("evil.test.", dnsmessage.ClassINET, 300, &dnsmessage.AResource{A: [4]byte{203, 0, 113, 66}}),
+		rr("web.test.", dnsmessage.ClassINET, 300, &dnsmessage.AAAAResource{AAAA: netip.MustParseAddr("2001:db8::1").As16()}),
+		rr("web.test.", dnsmessage.ClassCHAOS, 300, &dnsmessage.AResource{A: [4]byte{192, 0, 2, 99}}),
+	}
+
+	addrs, ttl, err := parseAddrResponse(pack(append(foreign,
+		rr("web.test.", dnsmessage.ClassINET, 300, &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}}),
+		cname)...), "www.test", 1, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0] != netip.MustParseAddr("192.0.2.1") || ttl != 30*time.Second {
+		t.Errorf("got %v with TTL %v, want only 192.0.2.1 with CNAME TTL", addrs, ttl)
+	}
+
+	_, _, err = parseAddrResponse(pack(append(foreign, cname)...), "www.test", 1, q)
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Errorf("got error %v, want not found for records outside of CNAME chain", err)
+	}
+}
+
+func TestDoQSlowHandshake(t *testing.T) {
+	// Server which never completes handshake
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	r, err := NewDoQResolver(pc.LocalAddr().String(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slowCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.LookupNetIP(slowCtx, "ip4", "example.test")
+	time.Sleep(10 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := r.LookupNetIP(ctx, "ip4", "example.test"); err == nil {
+		t.Fatal("lookup succeeded without handshake")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("caller waited for %v behind other's handshake", elapsed)
+	}
+}
+
+func TestResolverTransportsUseDialer(t *testing.T) {
+	pki := newTestPKI(t)
+	doh := newFakeDoH(t, pki, map[string][]netip.Addr{
+		"example.test": {netip.MustParseAddr("192.0.2.1")},
+	})
+	plainAddr := doh.ServePlain(t)
+	var dials atomic.Int64
+	dialer := dialerFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+		if network != "tcp" {
+			t.Errorf("stream transport dialed over %q", network)
+		}
+		dials.Add(1)
+		return (&net.Dialer{}).DialContext(ctx, network, address)
+	})
+
+	dot, err := NewDoTResolver(doh.ServeDoT(t, pki), dialer, &stdtls.Config{RootCAs: pki.pool})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, r := range map[string]*MessageResolver{
+		"udp":       NewPlainResolver(plainAddr, nil),
+		"udp-proxy": NewPlainResolver(plainAddr, dialer),
+		"tcp":       NewTCPResolver(plainAddr, dialer),
+		"doh":       doh.ResolverVia(t, pki, dialer),
+		"dot":       dot,
+	} {
+		before := dials.Load()
+		addrs, err := r.LookupNetIP(context.Background(), "ip4", "example.test")
+		if err != nil || len(addrs) != 1 {
+			t.Errorf("%s: got %v, %v", name, addrs, err)
+		}
+		if used := dials.Load() > before; used != (name != "udp") {
+			t.Errorf("%s: dialer used = %v", name, used)
+		}
+	}
+}
+
+func TestResolverOverProxy(t *testing.T) {
+	for _, tc := range []struct {
+		url string
+		tcp bool
+		err error
+	}{
+		{"1.1.1.1", true, nil},
+		{"dns://1.1.1.1:53", true, nil},
+		{"tcp://1.1.1.1", false, nil},
+		{"tls://1.1.1.1", false, nil},
+		{"https://1.1.1.1/dns-query", false, nil},
+		{"http://1.1.1.1/dns-query", false, PlainDoHOverProxyError},
+		{"QUIC://1.1.1.1", false, QUICOverProxyError},
+		{"h3://1.1.1.1/dns-query", false, QUICOverProxyError},
+	} {
+		tcp, err := ResolverOverProxy(tc.url)
+		if tcp != tc.tcp || !errors.Is(err, tc.err) {
+			t.Errorf("%s: got %v, %v, want %v, %v", tc.url, tcp, err, tc.tcp, tc.err)
+		}
+	}
+	proxied := dialerFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+		return nil, errors.New("unreachable")
+	})
+	if _, err := FromURL("http://1.1.1.1/dns-query", proxied); !errors.Is(err, PlainDoHOverProxyError) {
+		t.Errorf("got error %v, want %v", err, PlainDoHOverProxyError)
+	}
+}
+
+func TestQUICResolvers(t *testing.T) {
+	pki := newTestPKI(t)
+	doh := newFakeDoH(t, pki, map[string][]netip.Addr{
+		"example.test": {netip.MustParseAddr("192.0.2.1")},
+	})
+	tlsConfig := &stdtls.Config{RootCAs: pki.pool}
+	doqAddr := doh.ServeDoQ(t, pki)
+	doq, err := NewDoQResolver(doqAddr, nil, tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h3, err := NewH3Resolver(doh.ServeH3(t, pki), nil, tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, r := range map[string]*MessageResolver{"doq": doq, "h3": h3} {
+		// Second round reuses connection
+		for i := 0; i < 2; i++ {
+			addrs, ttl, err := r.LookupNetIPTTL(context.Background(), "ip", "example.test")
+			if err != nil || len(addrs) != 1 || ttl != 60*time.Second {
+				t.Errorf("%s: got %v, %v, %v", name, addrs, ttl, err)
+			}
+		}
+		_, err := r.LookupNetIP(context.Background(), "ip4", "missing.test")
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			t.Errorf("%s: got error %v, want not found", name, err)
+		}
+	}
+
+	// Caller giving up on waiting for stream keeps shared connection. Fresh
+	// resolver is used, so server has no finished streams to grant more
+	// credit for.
+	doq, err = NewDoQResolver(doqAddr, nil, tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := doq.exchanger.(*doqExchanger)
+	conn, err := e.connection(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		// Exhaust stream limit of connection
+		if _, err := conn.OpenStream(); err != nil {
+			break
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := doq.LookupNetIP(ctx, "ip4", "example.test"); err == nil {
+		t.Error("lookup succeeded without available streams")
+	}
+	if e.conn != conn || conn.Context().Err() != nil {
+		t.Error("shared connection is closed after caller's timeout")
+	}
+
+	proxied := dialerFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+		return nil, errors.New("unreachable")
+	})
+	for _, u := range []string{"quic://127.0.0.1", "doq://127.0.0.1:853", "h3://127.0.0.1/dns-query"} {
+		if _, err := FromURL(u, nil); err != nil {
+			t.Errorf("%s: %v", u, err)
+		}
+		if _, err := FromURL(u, proxied); !errors.Is(err, QUICOverProxyError) {
+			t.Errorf("%s: got error %v, want %v", u, err, QUICOverProxyError)
+		}
+	}
+}
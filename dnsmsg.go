@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	DNS_QUERY_TIMEOUT   = 10 * time.Second
+	MAX_DNS_MESSAGE     = 65535
+	DNS_MAX_CNAME_CHAIN = 8
+)
+
+var TruncatedDNSResponseError = errors.New("DNS response is truncated")
+
+// TTLLookuper is implemented by resolvers able to report how long lookup
+// result stays valid. Zero TTL means it is unknown.
+type TTLLookuper interface {
+	LookupNetIPTTL(ctx context.Context, network, host string) ([]netip.Addr, time.Duration, error)
+}
+
+// lookupTTL resolves host with its own answer TTL, falling back to regular
+// lookup with unknown TTL if resolver does not implement TTLLookuper
+func lookupTTL(ctx context.Context, r LookupNetIPer, network, host string) ([]netip.Addr, time.Duration, error) {
+	if tr, ok := r.(TTLLookuper); ok {
+		return tr.LookupNetIPTTL(ctx, network, host)
+	}
+	addrs, err := r.LookupNetIP(ctx, network, host)
+	return addrs, 0, err
+}
+
+// MessageResolver resolves names by sending DNS messages over exchanger,
+// so it can see TTLs of answers.
+type MessageResolver struct {
+	exchanger DNSExchanger
+}
+
+func NewMessageResolver(exchanger DNSExchanger) *MessageResolver {
+	return &MessageResolver{
+		exchanger: exchanger,
+	}
+}
+
+func (r *MessageResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	addrs, _, err := r.LookupNetIPTTL(ctx, network, host)
+	return addrs, err
+}
+
+func (r *MessageResolver) LookupNetIPTTL(ctx context.Context, network, host string) ([]netip.Addr, time.Duration, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{addr}, 0, nil
+	}
+	var qtypes []dnsmessage.Type
+	switch network {
+	case "ip4":
+		qtypes = []dnsmessage.Type{dnsmessage.TypeA}
+	case "ip6":
+		qtypes = []dnsmessage.Type{dnsmessage.TypeAAAA}
+	case "ip":
+		qtypes = []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}
+	default:
+		return nil, 0, fmt.Errorf("unsupported network %q", network)
+	}
+
+	type result struct {
+		addrs []netip.Addr
+		ttl   time.Duration
+		err   error
+	}
+	results := make(chan result, len(qtypes))
+	for _, qtype := range qtypes {
+		go func(qtype dnsmessage.Type) {
+			addrs, ttl, err := r.query(ctx, host, qtype)
+			results <- result{addrs, ttl, err}
+		}(qtype)
+	}
+	var (
+		addrs  []netip.Addr
+		ttl    time.Duration
+		negTTL time.Duration
+		resErr error
+	)
+	for range qtypes {
+		res := <-results
+		if res.err == nil {
+			if len(addrs) == 0 || res.ttl < ttl {
+				ttl = res.ttl
+			}
+			addrs = append(addrs, res.addrs...)
+			continue
+		}
+		// Prefer error which is not "not found"
+		var dnsErr *net.DNSError
+		if resErr == nil || errors.As(resErr, &dnsErr) && dnsErr.IsNotFound {
+			resErr = res.err
+		}
+		if res.ttl != 0 && (negTTL == 0 || res.ttl < negTTL) {
+			negTTL = res.ttl
+		}
+	}
+	if len(addrs) > 0 {
+		return addrs, ttl, nil
+	}
+	return nil, negTTL, resErr
+}
+
+// query performs single question exchange. For negative answers TTL is
+// derived from SOA record, if any.
+func (r *MessageResolver) query(ctx context.Context, host string, qtype dnsmessage.Type) ([]netip.Addr, time.Duration, error) {
+	fqdn := host
+	if !strings.HasSuffix(fqdn, ".") {
+		fqdn += "."
+	}
+	name, err := dnsmessage.NewName(fqdn)
+	if err != nil {
+		return nil, 0, &net.DNSError{Err: "invalid domain name", Name: host, IsNotFound: true}
+	}
+	id := uint16(RandomSource.Uint64())
+	q := dnsmessage.Question{
+		Name:  name,
+		Type:  qtype,
+		Class: dnsmessage.ClassINET,
+	}
+	query, err := (&dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:               id,
+			RecursionDesired: true,
+		},
+		Questions: []dnsmessage.Question{q},
+	}).Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := r.exchanger.Exchange(ctx, query)
+	if err != nil {
+		return nil, 0, &net.DNSError{Err: err.Error(), Name: host, IsTemporary: true, UnwrapErr: err}
+	}
+	return parseAddrResponse(resp, host, id, q)
+}
+
+// exchangeDNS sends query over connection obtained from dial and returns
+// response to it. Messages are framed with length prefix unless connection
+// is packet-oriented.
+func exchangeDNS(ctx context.Context, dial func(context.Context) (net.Conn, error), query []byte) ([]byte, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cl context.CancelFunc
+		ctx, cl = context.WithTimeout(ctx, DNS_QUERY_TIMEOUT)
+		defer cl()
+	}
+	conn, err := dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	id := binary.BigEndian.Uint16(query)
+	var resp []byte
+	err = withConnContext(ctx, conn, func() error {
+		_, isPacket := conn.(net.PacketConn)
+		if isPacket {
+			if _, err := conn.Write(query); err != nil {
+				return err
+			}
+			buf := make([]byte, MAX_DNS_MESSAGE)
+			for {
+				n, err := conn.Read(buf)
+				if err != nil {
+					return err
+				}
+				// Ignore stray datagrams
+				if n >= 2 && binary.BigEndian.Uint16(buf) == id {
+					resp = buf[:n]
+					return nil
+				}
+			}
+		}
+		framed := make([]byte, 2+len(query))
+		binary.BigEndian.PutUint16(framed, uint16(len(query)))
+		copy(framed[2:], query)
+		if _, err := conn.Write(framed); err != nil {
+			return err
+		}
+		var size [2]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return err
+		}
+		resp = make([]byte, binary.BigEndian.Uint16(size[:]))
+		_, err := io.ReadFull(conn, resp)
+		return err
+	})
+	return resp, err
+}
+
+// parseAddrResponse extracts addresses answering question q. Only records
+// of queried type and class which belong to CNAME chain starting at queried
+// name are taken.
+func parseAddrResponse(resp []byte, host string, id uint16, q dnsmessage.Question) ([]netip.Addr, time.Duration, error) {
+	malformed := &net.DNSError{Err: "malformed DNS response", Name: host, IsTemporary: true}
+	var p dnsmessage.Parser
+	hdr, err := p.Start(resp)
+	if err != nil {
+		return nil, 0, malformed
+	}
+	if hdr.ID != id || !hdr.Response {
+		return nil, 0, &net.DNSError{Err: "unexpected DNS response", Name: host, IsTemporary: true}
+	}
+	if hdr.Truncated {
+		return nil, 0, TruncatedDNSResponseError
+	}
+	switch hdr.RCode {
+	case dnsmessage.RCodeSuccess, dnsmessage.RCodeNameError:
+	default:
+		return nil, 0, &net.DNSError{Err: "server misbehaving: " + hdr.RCode.String(), Name: host, IsTemporary: true}
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, 0, malformed
+	}
+
+	type rrset struct {
+		addrs []netip.Addr
+		ttl   uint32
+	}
+	type alias struct {
+		target string
+		ttl    uint32
+	}
+	var (
+		owners = make(map[string]*rrset)
+		cnames = make(map[string]alias)
+	)
+	for {
+		rh, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return nil, 0, malformed
+		}
+		if rh.Class != q.Class {
+			if err := p.SkipAnswer(); err != nil {
+				return nil, 0, malformed
+			}
+			continue
+		}
+		owner := strings.ToLower(rh.Name.String())
+		var addr netip.Addr
+		switch {
+		case rh.Type == dnsmessage.TypeCNAME:
+			res, err := p.CNAMEResource()
+			if err != nil {
+				return nil, 0, malformed
+			}
+			cnames[owner] = alias{strings.ToLower(res.CNAME.String()), rh.TTL}
+			continue
+		case rh.Type != q.Type:
+			if err := p.SkipAnswer(); err != nil {
+				return nil, 0, malformed
+			}
+			continue
+		case rh.Type == dnsmessage.TypeA:
+			res, err := p.AResource()
+			if err != nil {
+				return nil, 0, malformed
+			}
+			addr = netip.AddrFrom4(res.A)
+		case rh.Type == dnsmessage.TypeAAAA:
+			res, err := p.AAAAResource()
+			if err != nil {
+				return nil, 0, malformed
+			}
+			addr = netip.AddrFrom16(res.AAAA)
+		default:
+			if err := p.SkipAnswer(); err != nil {
+				return nil, 0, malformed
+			}
+			continue
+		}
+		set := owners[owner]
+		if set == nil {
+			set = &rrset{ttl: rh.TTL}
+			owners[owner] = set
+		}
+		set.ttl = min(set.ttl, rh.TTL)
+		set.addrs = append(set.addrs, addr)
+	}
+
+	// Follow CNAME chain from queried name. TTL of answer is the least one
+	// among records of the chain.
+	name := strings.ToLower(q.Name.String())
+	var chainTTL uint32
+	for i := 0; i <= DNS_MAX_CNAME_CHAIN; i++ {
+		if set := owners[name]; set != nil {
+			if i > 0 {
+				set.ttl = min(set.ttl, chainTTL)
+			}
+			return set.addrs, time.Duration(set.ttl) * time.Second, nil
+		}
+		cname, ok := cnames[name]
+		if !ok {
+			break
+		}
+		if i == 0 || cname.ttl < chainTTL {
+			chainTTL = cname.ttl
+		}
+		name = cname.target
+	}
+
+	// Negative answer. Its TTL is the lesser of SOA TTL and SOA minimum.
+	var negTTL time.Duration
+	if err := p.SkipAllAnswers(); err == nil {
+		for {
+			rh, err := p.AuthorityHeader()
+			if err != nil {
+				break
+			}
+			if rh.Type != dnsmessage.TypeSOA {
+				if p.SkipAuthority() != nil {
+					break
+				}
+				continue
+			}
+			soa, err := p.SOAResource()
+			if err != nil {
+				break
+			}
+			negTTL = time.Duration(min(rh.TTL, soa.MinTTL)) * time.Second
+			break
+		}
+	}
+	return nil, negTTL, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
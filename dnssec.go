@@ -0,0 +1,711 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	_ "embed"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+//go:embed root-anchors.txt
+var bundledTrustAnchors string
+
+const (
+	DNSSEC_UDP_SIZE             = 1232
+	DNSSEC_CACHE_SIZE           = 1024
+	DNSSEC_MAX_CACHE_TTL        = 1 * time.Hour
+	DNSSEC_MAX_CNAME_CHAIN      = 8
+	DNSSEC_MAX_NSEC3_ITERATIONS = 150
+	NSEC3_OPT_OUT               = 1
+)
+
+var DNSSECBogusError = errors.New("DNSSEC validation failed")
+
+// ParseTrustAnchors reads DS records in zone file format
+func ParseTrustAnchors(rd io.Reader) ([]*dns.DS, error) {
+	var anchors []*dns.DS
+	zp := dns.NewZoneParser(rd, ".", "")
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		ds, isDS := rr.(*dns.DS)
+		if !isDS {
+			return nil, fmt.Errorf("trust anchor %q is not a DS record", rr.String())
+		}
+		ds.Hdr.Name = dns.CanonicalName(ds.Hdr.Name)
+		anchors = append(anchors, ds)
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+	if len(anchors) == 0 {
+		return nil, errors.New("no trust anchors found")
+	}
+	return anchors, nil
+}
+
+func BundledTrustAnchors() ([]*dns.DS, error) {
+	return ParseTrustAnchors(strings.NewReader(bundledTrustAnchors))
+}
+
+// dnssecZone holds validated keys of zone. Nil keys mean zone is proven to
+// be unsigned.
+type dnssecZone struct {
+	keys    []*dns.DNSKEY
+	expires time.Time
+}
+
+// validatingExchanger requests DNSSEC records along with answers and
+// rejects responses which can't be authenticated starting from trust
+// anchors, unless they come from zone which is provably unsigned.
+type validatingExchanger struct {
+	next    DNSExchanger
+	anchors []*dns.DS
+	mux     sync.Mutex
+	zones   map[string]dnssecZone
+}
+
+func NewValidatingExchanger(next DNSExchanger, anchors []*dns.DS) DNSExchanger {
+	return &validatingExchanger{
+		next:    next,
+		anchors: anchors,
+		zones:   make(map[string]dnssecZone),
+	}
+}
+
+// Validating returns resolver which checks DNSSEC signatures of answers
+// received by this resolver
+func (r *MessageResolver) Validating(anchors []*dns.DS) *MessageResolver {
+	return NewMessageResolver(NewValidatingExchanger(r.exchanger, anchors))
+}
+
+func (e *validatingExchanger) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	req := new(dns.Msg)
+	if err := req.Unpack(query); err != nil {
+		return nil, err
+	}
+	if len(req.Question) != 1 {
+		return e.next.Exchange(ctx, query)
+	}
+	if opt := req.IsEdns0(); opt != nil {
+		opt.SetDo()
+	} else {
+		req.SetEdns0(DNSSEC_UDP_SIZE, true)
+	}
+	resp, raw, err := e.exchange(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Truncated {
+		return raw, nil
+	}
+	chain, err := e.validate(ctx, req.Question[0], resp)
+	if err != nil {
+		return nil, fmt.Errorf("%w for %s: %w", DNSSECBogusError, req.Question[0].Name, err)
+	}
+	// Pass on only validated records, so nothing appended to answer
+	// reaches consumer
+	resp.Answer = chain
+	if slices.ContainsFunc(chain, func(rr dns.RR) bool { return rr.Header().Rrtype == req.Question[0].Qtype }) {
+		resp.Ns = nil
+	}
+	resp.Extra = slices.DeleteFunc(resp.Extra, func(rr dns.RR) bool {
+		return rr.Header().Rrtype != dns.TypeOPT
+	})
+	return resp.Pack()
+}
+
+func (e *validatingExchanger) exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, []byte, error) {
+	query, err := req.Pack()
+	if err != nil {
+		return nil, nil, err
+	}
+	raw, err := e.next.Exchange(ctx, query)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp := new(dns.Msg)
+	if err := resp.Unpack(raw); err != nil {
+		return nil, nil, err
+	}
+	if resp.Id != req.Id || !resp.Response {
+		return nil, nil, errors.New("unexpected DNS response")
+	}
+	return resp, raw, nil
+}
+
+// query fetches records required to validate answer
+func (e *validatingExchanger) query(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	req := new(dns.Msg)
+	req.SetQuestion(name, qtype)
+	req.Id = uint16(RandomSource.Uint64())
+	req.SetEdns0(DNSSEC_UDP_SIZE, true)
+	resp, _, err := e.exchange(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Truncated {
+		return nil, TruncatedDNSResponseError
+	}
+	switch resp.Rcode {
+	case dns.RcodeSuccess, dns.RcodeNameError:
+	default:
+		return nil, fmt.Errorf("%s query for %s failed: %s", dns.TypeToString[qtype], name, dns.RcodeToString[resp.Rcode])
+	}
+	return resp, nil
+}
+
+// validate follows CNAME chain of response, checking every RRset on the
+// way, and checks denial of existence if chain ends with no data. Returns
+// records of validated chain with their signatures.
+func (e *validatingExchanger) validate(ctx context.Context, q dns.Question, resp *dns.Msg) ([]dns.RR, error) {
+	switch resp.Rcode {
+	case dns.RcodeSuccess, dns.RcodeNameError:
+	default:
+		// Nothing to validate, failure is handled by caller
+		return nil, nil
+	}
+	var chain []dns.RR
+	appendRRset := func(rrset []dns.RR, sigs []*dns.RRSIG) {
+		chain = append(chain, rrset...)
+		for _, sig := range sigs {
+			chain = append(chain, sig)
+		}
+	}
+	name := q.Name
+	for range DNSSEC_MAX_CNAME_CHAIN {
+		if rrset, sigs := findRRset(resp.Answer, name, q.Qtype); len(rrset) > 0 {
+			if err := e.verifyRRset(ctx, rrset, sigs); err != nil {
+				return nil, err
+			}
+			appendRRset(rrset, sigs)
+			return chain, outsideChain(resp.Answer, chain)
+		}
+		rrset, sigs := findRRset(resp.Answer, name, dns.TypeCNAME)
+		if len(rrset) == 0 {
+			if err := outsideChain(resp.Answer, chain); err != nil {
+				return nil, err
+			}
+			return chain, e.verifyDenial(ctx, resp, name, q.Qtype)
+		}
+		if err := e.verifyRRset(ctx, rrset, sigs); err != nil {
+			return nil, err
+		}
+		appendRRset(rrset, sigs)
+		name = rrset[0].(*dns.CNAME).Target
+	}
+	return nil, errors.New("CNAME chain is too long")
+}
+
+// outsideChain rejects answer records which don't belong to validated
+// chain. DNAME records are tolerated as they come along with CNAME
+// synthesized from them.
+func outsideChain(answer, chain []dns.RR) error {
+	for _, rr := range answer {
+		hdr := rr.Header()
+		if hdr.Rrtype == dns.TypeDNAME || hdr.Rrtype == dns.TypeOPT {
+			continue
+		}
+		if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == dns.TypeDNAME {
+			continue
+		}
+		if !slices.Contains(chain, rr) {
+			return fmt.Errorf("%s/%s is outside of answer chain", hdr.Name, dns.TypeToString[hdr.Rrtype])
+		}
+	}
+	return nil
+}
+
+func (e *validatingExchanger) verifyRRset(ctx context.Context, rrset []dns.RR, sigs []*dns.RRSIG) error {
+	owner := rrset[0].Header().Name
+	err := fmt.Errorf("%s/%s is not signed", owner, dns.TypeToString[rrset[0].Header().Rrtype])
+	for _, sig := range sigs {
+		if !dns.IsSubDomain(sig.SignerName, owner) {
+			continue
+		}
+		var keys []*dns.DNSKEY
+		if keys, err = e.zoneKeys(ctx, sig.SignerName); err != nil {
+			continue
+		}
+		if err = verifySigs(rrset, []*dns.RRSIG{sig}, keys); err == nil {
+			return nil
+		}
+	}
+	return e.insecureOr(ctx, owner, err)
+}
+
+// verifyDenial checks proof of nonexistence of name or of its records of
+// qtype
+func (e *validatingExchanger) verifyDenial(ctx context.Context, resp *dns.Msg, name string, qtype uint16) error {
+	var zone string
+	for _, rr := range resp.Ns {
+		if sig, ok := rr.(*dns.RRSIG); ok && dns.IsSubDomain(sig.SignerName, name) {
+			zone = sig.SignerName
+			break
+		}
+	}
+	if zone == "" {
+		return e.insecureOr(ctx, name, fmt.Errorf("negative answer for %s is not signed", name))
+	}
+	keys, err := e.zoneKeys(ctx, zone)
+	if err != nil {
+		return e.insecureOr(ctx, name, err)
+	}
+	nsecs, nsec3s, err := authenticatedDenial(resp, zone, keys)
+	if err != nil {
+		return err
+	}
+	if resp.Rcode == dns.RcodeNameError {
+		if nxdomainProven(name, nsecs, nsec3s) {
+			return nil
+		}
+		return fmt.Errorf("no proof of nonexistence of %s", name)
+	}
+	if nodataProven(name, qtype, nsecs, nsec3s) {
+		return nil
+	}
+	return fmt.Errorf("no proof of nonexistence of %s/%s", name, dns.TypeToString[qtype])
+}
+
+// insecureOr accepts data of name which failed validation with err only
+// if name belongs to unsigned zone
+func (e *validatingExchanger) insecureOr(ctx context.Context, name string, err error) error {
+	insecure, perr := e.provenInsecure(ctx, name)
+	if perr != nil {
+		return perr
+	}
+	if insecure {
+		return nil
+	}
+	return err
+}
+
+// zoneKeys returns keys of zone authenticated by chain of DS records
+// leading to trust anchor
+func (e *validatingExchanger) zoneKeys(ctx context.Context, zone string) ([]*dns.DNSKEY, error) {
+	zone = dns.CanonicalName(zone)
+	if keys, ok := e.cached(zone); ok && keys != nil {
+		return keys, nil
+	}
+	if dsSet := e.anchorsOf(zone); len(dsSet) > 0 {
+		return e.childKeys(ctx, zone, dsSet, DNSSEC_MAX_CACHE_TTL)
+	}
+	if zone == "." {
+		return nil, errors.New("no trust anchor for root zone")
+	}
+	resp, err := e.query(ctx, zone, dns.TypeDS)
+	if err != nil {
+		return nil, err
+	}
+	rrset, sigs := findRRset(resp.Answer, zone, dns.TypeDS)
+	if len(rrset) == 0 {
+		return nil, fmt.Errorf("no DS records for %s", zone)
+	}
+	err = fmt.Errorf("DS records of %s are not signed", zone)
+	for _, sig := range sigs {
+		parent := dns.CanonicalName(sig.SignerName)
+		if parent == zone || !dns.IsSubDomain(parent, zone) {
+			continue
+		}
+		var parentKeys []*dns.DNSKEY
+		if parentKeys, err = e.zoneKeys(ctx, parent); err != nil {
+			continue
+		}
+		if err = verifySigs(rrset, []*dns.RRSIG{sig}, parentKeys); err == nil {
+			return e.childKeys(ctx, zone, dsRecords(rrset), rrsetTTL(rrset))
+		}
+	}
+	return nil, err
+}
+
+// childKeys fetches DNSKEY records of zone and authenticates them with
+// DS records from parent zone
+func (e *validatingExchanger) childKeys(ctx context.Context, zone string, dsSet []*dns.DS, ttl time.Duration) ([]*dns.DNSKEY, error) {
+	resp, err := e.query(ctx, zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, err
+	}
+	rrset, sigs := findRRset(resp.Answer, zone, dns.TypeDNSKEY)
+	var keys, trusted []*dns.DNSKEY
+	for _, rr := range rrset {
+		key := rr.(*dns.DNSKEY)
+		keys = append(keys, key)
+		for _, ds := range dsSet {
+			if ds.KeyTag != key.KeyTag() || ds.Algorithm != key.Algorithm {
+				continue
+			}
+			if digest := key.ToDS(ds.DigestType); digest != nil && strings.EqualFold(digest.Digest, ds.Digest) {
+				trusted = append(trusted, key)
+				break
+			}
+		}
+	}
+	if len(trusted) == 0 {
+		return nil, fmt.Errorf("no DNSKEY of %s matches its DS records", zone)
+	}
+	if err := verifySigs(rrset, sigs, trusted); err != nil {
+		return nil, err
+	}
+	e.store(zone, keys, min(ttl, rrsetTTL(rrset)))
+	return keys, nil
+}
+
+// provenInsecure walks down from closest trust anchor to name, looking for
+// delegation to unsigned zone authenticated by its parent
+func (e *validatingExchanger) provenInsecure(ctx context.Context, name string) (bool, error) {
+	name = dns.CanonicalName(name)
+	zone := ""
+	for _, ds := range e.anchors {
+		if dns.IsSubDomain(ds.Hdr.Name, name) && len(ds.Hdr.Name) > len(zone) {
+			zone = ds.Hdr.Name
+		}
+	}
+	if zone == "" {
+		// Nothing to validate against
+		return true, nil
+	}
+	keys, err := e.zoneKeys(ctx, zone)
+	if err != nil {
+		return false, err
+	}
+	labels := dns.SplitDomainName(name)
+	for i := len(labels) - dns.CountLabel(zone) - 1; i >= 0; i-- {
+		child := dns.Fqdn(strings.Join(labels[i:], "."))
+		if childKeys, ok := e.cached(child); ok {
+			if childKeys == nil {
+				return true, nil
+			}
+			zone, keys = child, childKeys
+			continue
+		}
+		resp, err := e.query(ctx, child, dns.TypeDS)
+		if err != nil {
+			return false, err
+		}
+		if rrset, sigs := findRRset(resp.Answer, child, dns.TypeDS); len(rrset) > 0 {
+			if err := verifySigs(rrset, sigs, keys); err != nil {
+				return false, err
+			}
+			if keys, err = e.childKeys(ctx, child, dsRecords(rrset), rrsetTTL(rrset)); err != nil {
+				return false, err
+			}
+			zone = child
+			continue
+		}
+		cut, err := dsDenied(resp, child, zone, keys)
+		if err != nil {
+			return false, err
+		}
+		if cut {
+			e.store(child, nil, rrsetTTL(resp.Ns))
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// dsDenied checks proof of DS absence for child in zone and reports if
+// child is delegation to unsigned zone
+func dsDenied(resp *dns.Msg, child, zone string, keys []*dns.DNSKEY) (bool, error) {
+	nsecs, nsec3s, err := authenticatedDenial(resp, zone, keys)
+	if err != nil {
+		return false, err
+	}
+	isCut := func(bitmap []uint16) (bool, error) {
+		if slices.Contains(bitmap, dns.TypeDS) {
+			return false, fmt.Errorf("DS records of %s are denied, but listed in NSEC", child)
+		}
+		return slices.Contains(bitmap, dns.TypeNS) && !slices.Contains(bitmap, dns.TypeSOA), nil
+	}
+	for _, n := range nsecs {
+		if strings.EqualFold(n.Hdr.Name, child) {
+			return isCut(n.TypeBitMap)
+		}
+	}
+	for _, n := range nsecs {
+		// Empty non-terminal
+		if resp.Rcode == dns.RcodeSuccess && nsecCovers(n, child) && dns.IsSubDomain(child, n.NextDomain) {
+			return false, nil
+		}
+	}
+	if n := nsec3Match(nsec3s, child); n != nil {
+		return isCut(n.TypeBitMap)
+	}
+	// Span of opt-out NSEC3 may contain unsigned delegations
+	if _, nc, ok := nsec3ClosestEncloser(child, nsec3s); ok && nc.Flags&NSEC3_OPT_OUT != 0 {
+		return true, nil
+	}
+	return false, fmt.Errorf("no proof of DS absence for %s", child)
+}
+
+// authenticatedDenial returns NSEC and NSEC3 records of response after
+// checking their signatures with keys of zone
+func authenticatedDenial(resp *dns.Msg, zone string, keys []*dns.DNSKEY) ([]*dns.NSEC, []*dns.NSEC3, error) {
+	var (
+		nsecs  []*dns.NSEC
+		nsec3s []*dns.NSEC3
+	)
+	for _, rr := range resp.Ns {
+		hdr := rr.Header()
+		if hdr.Rrtype != dns.TypeNSEC && hdr.Rrtype != dns.TypeNSEC3 {
+			continue
+		}
+		if n, ok := rr.(*dns.NSEC3); ok && (n.Hash != dns.SHA1 || n.Iterations > DNSSEC_MAX_NSEC3_ITERATIONS) {
+			continue
+		}
+		if !dns.IsSubDomain(zone, hdr.Name) {
+			return nil, nil, fmt.Errorf("%s record %s is outside of zone %s", dns.TypeToString[hdr.Rrtype], hdr.Name, zone)
+		}
+		_, sigs := findRRset(resp.Ns, hdr.Name, hdr.Rrtype)
+		if err := verifySigs([]dns.RR{rr}, sigs, keys); err != nil {
+			return nil, nil, err
+		}
+		switch n := rr.(type) {
+		case *dns.NSEC:
+			nsecs = append(nsecs, n)
+		case *dns.NSEC3:
+			nsec3s = append(nsec3s, n)
+		}
+	}
+	return nsecs, nsec3s, nil
+}
+
+func nxdomainProven(name string, nsecs []*dns.NSEC, nsec3s []*dns.NSEC3) bool {
+	for _, n := range nsecs {
+		if !nsecCovers(n, name) {
+			continue
+		}
+		// Name could still be synthesized from wildcard at closest encloser
+		wildcard := wildcardOf(nsecClosestEncloser(name, n))
+		for _, w := range nsecs {
+			if nsecCovers(w, wildcard) {
+				return true
+			}
+		}
+	}
+	if ce, nc, ok := nsec3ClosestEncloser(name, nsec3s); ok {
+		if nc.Flags&NSEC3_OPT_OUT != 0 {
+			// Name may belong to unsigned delegation
+			return true
+		}
+		return nsec3Cover(nsec3s, wildcardOf(ce)) != nil
+	}
+	return false
+}
+
+func nodataProven(name string, qtype uint16, nsecs []*dns.NSEC, nsec3s []*dns.NSEC3) bool {
+	lacks := func(bitmap []uint16) bool {
+		return !slices.Contains(bitmap, qtype) && !slices.Contains(bitmap, dns.TypeCNAME)
+	}
+	for _, n := range nsecs {
+		if strings.EqualFold(n.Hdr.Name, name) {
+			return lacks(n.TypeBitMap)
+		}
+	}
+	if n := nsec3Match(nsec3s, name); n != nil {
+		return lacks(n.TypeBitMap)
+	}
+	for _, n := range nsecs {
+		if !nsecCovers(n, name) {
+			continue
+		}
+		// Empty non-terminal
+		if dns.IsSubDomain(name, n.NextDomain) {
+			return true
+		}
+		// Answer synthesized from wildcard lacks records of qtype
+		wildcard := wildcardOf(nsecClosestEncloser(name, n))
+		for _, w := range nsecs {
+			if strings.EqualFold(w.Hdr.Name, wildcard) {
+				return lacks(w.TypeBitMap)
+			}
+		}
+	}
+	if ce, _, ok := nsec3ClosestEncloser(name, nsec3s); ok {
+		if w := nsec3Match(nsec3s, wildcardOf(ce)); w != nil {
+			return lacks(w.TypeBitMap)
+		}
+	}
+	return false
+}
+
+// nsecCovers reports if name falls strictly between owner and next name of
+// NSEC record
+func nsecCovers(n *dns.NSEC, name string) bool {
+	owner, next := n.Hdr.Name, n.NextDomain
+	if canonicalCompare(owner, next) < 0 {
+		return canonicalCompare(owner, name) < 0 && canonicalCompare(name, next) < 0
+	}
+	// Last record of zone wraps around to its apex
+	return canonicalCompare(owner, name) < 0 || canonicalCompare(name, next) < 0
+}
+
+// nsecClosestEncloser returns longest existing ancestor of name covered by
+// NSEC record
+func nsecClosestEncloser(name string, n *dns.NSEC) string {
+	common := max(dns.CompareDomainName(name, n.Hdr.Name), dns.CompareDomainName(name, n.NextDomain))
+	labels := dns.SplitDomainName(name)
+	return dns.Fqdn(strings.Join(labels[len(labels)-common:], "."))
+}
+
+// nsec3ClosestEncloser finds longest ancestor of name having matching NSEC3
+// record and returns it along with NSEC3 record covering next closer name
+func nsec3ClosestEncloser(name string, nsec3s []*dns.NSEC3) (string, *dns.NSEC3, bool) {
+	nextCloser := name
+	for off, end := dns.NextLabel(name, 0); !end; off, end = dns.NextLabel(name, off) {
+		candidate := name[off:]
+		if nsec3Match(nsec3s, candidate) != nil {
+			nc := nsec3Cover(nsec3s, nextCloser)
+			return candidate, nc, nc != nil
+		}
+		nextCloser = candidate
+	}
+	return "", nil, false
+}
+
+func nsec3Match(nsec3s []*dns.NSEC3, name string) *dns.NSEC3 {
+	for _, n := range nsec3s {
+		if n.Match(name) {
+			return n
+		}
+	}
+	return nil
+}
+
+func nsec3Cover(nsec3s []*dns.NSEC3, name string) *dns.NSEC3 {
+	for _, n := range nsec3s {
+		if n.Cover(name) {
+			return n
+		}
+	}
+	return nil
+}
+
+func wildcardOf(name string) string {
+	if name == "." {
+		return "*."
+	}
+	return "*." + name
+}
+
+// canonicalCompare orders names as defined in RFC 4034 section 6.1
+func canonicalCompare(a, b string) int {
+	la := dns.SplitDomainName(strings.ToLower(a))
+	lb := dns.SplitDomainName(strings.ToLower(b))
+	for i, j := len(la)-1, len(lb)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if c := strings.Compare(la[i], lb[j]); c != 0 {
+			return c
+		}
+	}
+	return cmp.Compare(len(la), len(lb))
+}
+
+// verifySigs checks if any of sigs is valid signature of rrset made with
+// one of keys
+func verifySigs(rrset []dns.RR, sigs []*dns.RRSIG, keys []*dns.DNSKEY) error {
+	hdr := rrset[0].Header()
+	if len(sigs) == 0 {
+		return fmt.Errorf("%s/%s is not signed", hdr.Name, dns.TypeToString[hdr.Rrtype])
+	}
+	now := time.Now()
+	for _, sig := range sigs {
+		if !sig.ValidityPeriod(now) {
+			continue
+		}
+		for _, key := range keys {
+			if key.KeyTag() == sig.KeyTag && sig.Verify(key, rrset) == nil {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("no valid signature of %s/%s", hdr.Name, dns.TypeToString[hdr.Rrtype])
+}
+
+// findRRset picks records of given name and type along with signatures
+// covering them
+func findRRset(rrs []dns.RR, name string, rrtype uint16) ([]dns.RR, []*dns.RRSIG) {
+	var (
+		rrset []dns.RR
+		sigs  []*dns.RRSIG
+	)
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		if hdr.Class != dns.ClassINET || !strings.EqualFold(hdr.Name, name) {
+			continue
+		}
+		if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == rrtype {
+			sigs = append(sigs, sig)
+		} else if hdr.Rrtype == rrtype {
+			rrset = append(rrset, rr)
+		}
+	}
+	return rrset, sigs
+}
+
+func dsRecords(rrset []dns.RR) []*dns.DS {
+	res := make([]*dns.DS, 0, len(rrset))
+	for _, rr := range rrset {
+		res = append(res, rr.(*dns.DS))
+	}
+	return res
+}
+
+func rrsetTTL(rrs []dns.RR) time.Duration {
+	ttl := DNSSEC_MAX_CACHE_TTL
+	for _, rr := range rrs {
+		ttl = min(ttl, time.Duration(rr.Header().Ttl)*time.Second)
+	}
+	return ttl
+}
+
+func (e *validatingExchanger) anchorsOf(zone string) []*dns.DS {
+	var res []*dns.DS
+	for _, ds := range e.anchors {
+		if ds.Hdr.Name == zone {
+			res = append(res, ds)
+		}
+	}
+	return res
+}
+
+func (e *validatingExchanger) cached(zone string) ([]*dns.DNSKEY, bool) {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	z, ok := e.zones[zone]
+	if !ok || !time.Now().Before(z.expires) {
+		return nil, false
+	}
+	return z.keys, true
+}
+
+func (e *validatingExchanger) store(zone string, keys []*dns.DNSKEY, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	now := time.Now()
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	if _, ok := e.zones[zone]; !ok && len(e.zones) >= DNSSEC_CACHE_SIZE {
+		for name, z := range e.zones {
+			if !now.Before(z.expires) {
+				delete(e.zones, name)
+			}
+		}
+		for name := range e.zones {
+			if len(e.zones) < DNSSEC_CACHE_SIZE {
+				break
+			}
+			delete(e.zones, name)
+		}
+	}
+	e.zones[zone] = dnssecZone{
+		keys:    keys,
+		expires: now.Add(ttl),
+	}
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type rrKey struct {
+	name   string
+	rrtype uint16
+}
+
+// testZone is authoritative data of single zone, optionally signed
+type testZone struct {
+	origin string
+	key    *dns.DNSKEY
+	signer crypto.Signer
+	rrsets map[rrKey][]dns.RR
+	sigs   map[rrKey]*dns.RRSIG
+	nsecs  []*dns.NSEC
+}
+
+func newTestZone(t *testing.T, origin string, signed bool, records ...string) *testZone {
+	t.Helper()
+	z := &testZone{
+		origin: origin,
+		rrsets: make(map[rrKey][]dns.RR),
+		sigs:   make(map[rrKey]*dns.RRSIG),
+	}
+	z.add(t, origin+" 300 IN SOA ns."+origin+" admin."+origin+" 1 3600 600 86400 300")
+	z.add(t, origin+" 300 IN NS ns."+origin)
+	for _, record := range records {
+		z.add(t, record)
+	}
+	if signed {
+		z.key = &dns.DNSKEY{
+			Hdr:       dns.RR_Header{Name: origin, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 300},
+			Flags:     dns.ZONE | dns.SEP,
+			Protocol:  3,
+			Algorithm: dns.ECDSAP256SHA256,
+		}
+		priv, err := z.key.Generate(256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		z.signer = priv.(crypto.Signer)
+		z.addRR(z.key)
+	}
+	return z
+}
+
+func (z *testZone) add(t *testing.T, record string) {
+	t.Helper()
+	rr, err := dns.NewRR(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	z.addRR(rr)
+}
+
+func (z *testZone) addRR(rr dns.RR) {
+	key := rrKey{dns.CanonicalName(rr.Header().Name), rr.Header().Rrtype}
+	z.rrsets[key] = append(z.rrsets[key], rr)
+}
+
+// delegate adds delegation to child zone, secure if child is signed
+func (z *testZone) delegate(child *testZone) {
+	z.addRR(&dns.NS{
+		Hdr: dns.RR_Header{Name: child.origin, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 300},
+		Ns:  "ns." + child.origin,
+	})
+	if child.key != nil {
+		ds := child.key.ToDS(dns.SHA256)
+		ds.Hdr.Ttl = 300
+		z.addRR(ds)
+	}
+}
+
+// sign builds NSEC chain and signs all authoritative data of zone
+func (z *testZone) sign(t *testing.T) {
+	t.Helper()
+	if z.key == nil {
+		return
+	}
+	types := make(map[string][]uint16)
+	for key := range z.rrsets {
+		types[key.name] = append(types[key.name], key.rrtype)
+	}
+	names := make([]string, 0, len(types))
+	for name := range types {
+		names = append(names, name)
+	}
+	slices.SortFunc(names, canonicalCompare)
+	for i, name := range names {
+		bitmap := append(types[name], dns.TypeNSEC, dns.TypeRRSIG)
+		slices.Sort(bitmap)
+		z.addRR(&dns.NSEC{
+			Hdr:        dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 300},
+			NextDomain: names[(i+1)%len(names)],
+			TypeBitMap: bitmap,
+		})
+	}
+	now := time.Now()
+	for key, rrset := range z.rrsets {
+		// Delegation is not authoritative data of parent
+		if key.rrtype == dns.TypeNS && key.name != z.origin {
+			continue
+		}
+		sig := &dns.RRSIG{
+			Algorithm:  z.key.Algorithm,
+			SignerName: z.origin,
+			KeyTag:     z.key.KeyTag(),
+			Inception:  uint32(now.Add(-time.Hour).Unix()),
+			Expiration: uint32(now.Add(time.Hour).Unix()),
+		}
+		if err := sig.Sign(z.signer, rrset); err != nil {
+			t.Fatal(err)
+		}
+		z.sigs[key] = sig
+		if key.rrtype == dns.TypeNSEC {
+			z.nsecs = append(z.nsecs, rrset[0].(*dns.NSEC))
+		}
+	}
+}
+
+func (z *testZone) rrsetWithSig(name string, rrtype uint16) []dns.RR {
+	key := rrKey{name, rrtype}
+	rrset := slices.Clone(z.rrsets[key])
+	if sig, ok := z.sigs[key]; ok {
+		rrset = append(rrset, sig)
+	}
+	return rrset
+}
+
+// testResolver answers queries from set of zones like recursive resolver.
+// Its responses can be altered to simulate attacks.
+type testResolver struct {
+	zones  []*testZone
+	tamper func(q dns.Question, resp *dns.Msg)
+}
+
+func (r *testResolver) zoneOf(name string, qtype uint16) *testZone {
+	var best *testZone
+	for _, z := range r.zones {
+		if !dns.IsSubDomain(z.origin, name) || qtype == dns.TypeDS && z.origin == name {
+			continue
+		}
+		if best == nil || len(z.origin) > len(best.origin) {
+			best = z
+		}
+	}
+	return best
+}
+
+func (r *testResolver) resolve(resp *dns.Msg, name string, qtype uint16) {
+	z := r.zoneOf(name, qtype)
+	if rrset := z.rrsetWithSig(name, qtype); len(rrset) > 0 {
+		resp.Answer = append(resp.Answer, rrset...)
+		return
+	}
+	if rrset := z.rrsetWithSig(name, dns.TypeCNAME); len(rrset) > 0 {
+		resp.Answer = append(resp.Answer, rrset...)
+		r.resolve(resp, rrset[0].(*dns.CNAME).Target, qtype)
+		return
+	}
+	resp.Ns = append(resp.Ns, z.rrsetWithSig(z.origin, dns.TypeSOA)...)
+	if len(z.rrsetWithSig(name, dns.TypeNSEC)) > 0 {
+		resp.Ns = append(resp.Ns, z.rrsetWithSig(name, dns.TypeNSEC)...)
+		return
+	}
+	exists := false
+	for key := range z.rrsets {
+		if key.name == name {
+			exists = true
+		}
+	}
+	if exists {
+		return
+	}
+	resp.Rcode = dns.RcodeNameError
+	for _, covered := range []string{name, "*." + z.origin} {
+		for _, n := range z.nsecs {
+			if nsecCovers(n, covered) && len(z.rrsetWithSig(n.Hdr.Name, dns.TypeNSEC)) > 0 &&
+				!slices.Contains(resp.Ns, dns.RR(n)) {
+				resp.Ns = append(resp.Ns, z.rrsetWithSig(n.Hdr.Name, dns.TypeNSEC)...)
+			}
+		}
+	}
+}
+
+func (r *testResolver) Exchange(_ context.Context, query []byte) ([]byte, error) {
+	req := new(dns.Msg)
+	if err := req.Unpack(query); err != nil {
+		return nil, err
+	}
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.RecursionAvailable = true
+	q := req.Question[0]
+	r.resolve(resp, dns.CanonicalName(q.Name), q.Qtype)
+	if r.tamper != nil {
+		r.tamper(q, resp)
+	}
+	return resp.Pack()
+}
+
+// newTestResolver builds signed zone "test." with signed child zone
+// "secure.test." and unsigned child zone "insecure.test.". Returned trust
+// anchors refer to key of "test.".
+func newTestResolver(t *testing.T) (*testResolver, []*dns.DS) {
+	t.Helper()
+	secure := newTestZone(t, "secure.test.", true,
+		"www.secure.test. 300 IN A 192.0.2.2",
+	)
+	insecure := newTestZone(t, "insecure.test.", false,
+		"www.insecure.test. 300 IN A 192.0.2.3",
+	)
+	parent := newTestZone(t, "test.", true,
+		"www.test. 300 IN A 192.0.2.1",
+		"www.test. 300 IN AAAA 2001:db8::1",
+		"alias.test. 300 IN CNAME www.secure.test.",
+	)
+	parent.delegate(secure)
+	parent.delegate(insecure)
+	parent.sign(t)
+	secure.sign(t)
+	anchor := parent.key.ToDS(dns.SHA256)
+	return &testResolver{zones: []*testZone{parent, secure, insecure}}, []*dns.DS{anchor}
+}
+
+func TestValidatingResolver(t *testing.T) {
+	upstream, anchors := newTestResolver(t)
+	r := NewMessageResolver(upstream).Validating(anchors)
+	for host, want := range map[string][]string{
+		"www.test":          {"192.0.2.1", "2001:db8::1"},
+		"www.secure.test":   {"192.0.2.2"},
+		"alias.test":        {"192.0.2.2"},
+		"www.insecure.test": {"192.0.2.3"},
+	} {
+		addrs, err := r.LookupNetIP(context.Background(), "ip", host)
+		if err != nil {
+			t.Errorf("%s: %v", host, err)
+			continue
+		}
+		var got []string
+		for _, addr := range addrs {
+			got = append(got, addr.String())
+		}
+		slices.Sort(got)
+		if !slices.Equal(got, want) {
+			t.Errorf("%s: got %v, want %v", host, got, want)
+		}
+	}
+	for _, host := range []string{"missing.test", "missing.secure.test"} {
+		_, err := r.LookupNetIP(context.Background(), "ip4", host)
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			t.Errorf("%s: got error %v, want not found", host, err)
+		}
+	}
+}
+
+func TestValidatingResolverBogus(t *testing.T) {
+	stripSigs := func(resp *dns.Msg) {
+		resp.Answer = slices.DeleteFunc(resp.Answer, func(rr dns.RR) bool {
+			return rr.Header().Rrtype == dns.TypeRRSIG
+		})
+	}
+	for _, tc := range []struct {
+		name   string
+		host   string
+		tamper func(resp *dns.Msg)
+	}{
+		{"forged address", "www.test.", func(resp *dns.Msg) {
+			for _, rr := range resp.Answer {
+				if a, ok := rr.(*dns.A); ok {
+					a.A = net.ParseIP("203.0.113.66")
+				}
+			}
+		}},
+		{"stripped signature", "www.test.", stripSigs},
+		{"stripped signature in signed child", "www.secure.test.", stripSigs},
+		{"forged CNAME", "alias.test.", func(resp *dns.Msg) {
+			for _, rr := range resp.Answer {
+				if cname, ok := rr.(*dns.CNAME); ok {
+					cname.Target = "www.insecure.test."
+				}
+			}
+		}},
+		{"unsigned record outside of chain", "www.test.", func(resp *dns.Msg) {
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: "evil.example.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+				A:   net.ParseIP("203.0.113.66"),
+			})
+		}},
+		{"forged nonexistence", "www.test.", func(resp *dns.Msg) {
+			resp.Rcode = dns.RcodeNameError
+			resp.Answer = nil
+		}},
+	} {
+		upstream, anchors := newTestResolver(t)
+		upstream.tamper = func(q dns.Question, resp *dns.Msg) {
+			if q.Name == tc.host && q.Qtype == dns.TypeA {
+				tc.tamper(resp)
+			}
+		}
+		req := new(dns.Msg)
+		req.SetQuestion(tc.host, dns.TypeA)
+		query, err := req.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = NewValidatingExchanger(upstream, anchors).Exchange(context.Background(), query)
+		if !errors.Is(err, DNSSECBogusError) {
+			t.Errorf("%s: got error %v, want %v", tc.name, err, DNSSECBogusError)
+		}
+	}
+}
+
+func TestValidatingResolverInsecureSpoof(t *testing.T) {
+	// Unsigned answer is accepted for unsigned zone only, so denial of DS
+	// of signed child zone must not pass
+	upstream, anchors := newTestResolver(t)
+	upstream.tamper = func(q dns.Question, resp *dns.Msg) {
+		if q.Name == "secure.test." && q.Qtype == dns.TypeDS {
+			resp.Answer = nil
+		}
+		if q.Name == "www.secure.test." {
+			resp.Answer = []dns.RR{&dns.A{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+				A:   net.ParseIP("203.0.113.66"),
+			}}
+		}
+	}
+	r := NewMessageResolver(upstream).Validating(anchors)
+	addrs, err := r.LookupNetIP(context.Background(), "ip4", "www.secure.test")
+	if err == nil {
+		t.Fatalf("spoofed answer %v accepted", addrs)
+	}
+}
+
+func TestCanonicalCompare(t *testing.T) {
+	// Example from RFC 4034 section 6.1
+	ordered := []string{
+		"example.",
+		"a.example.",
+		"yljkjljk.a.example.",
+		"Z.a.example.",
+		"zABC.a.EXAMPLE.",
+		"z.example.",
+		"*.z.example.",
+		"\\200.z.example.",
+	}
+	shuffled := slices.Clone(ordered)
+	slices.Reverse(shuffled)
+	slices.SortFunc(shuffled, canonicalCompare)
+	if !slices.EqualFunc(shuffled, ordered, strings.EqualFold) {
+		t.Errorf("got order %v", shuffled)
+	}
+}
+
+func TestBundledTrustAnchors(t *testing.T) {
+	anchors, err := BundledTrustAnchors()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ds := range anchors {
+		if ds.Hdr.Name != "." {
+			t.Errorf("unexpected trust anchor %s", ds)
+		}
+	}
+	if _, err := ParseTrustAnchors(strings.NewReader("example. IN A 192.0.2.1\n")); err == nil {
+		t.Error("non-DS trust anchor accepted")
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// TTL of served answers if upstream TTL is unknown
+	DNS_SERVER_DEFAULT_TTL      = 1 * time.Minute
+	DNS_SERVER_UDP_SIZE         = 512
+	DNS_SERVER_EDNS_UDP_SIZE    = 1232
+	DNS_SERVER_TCP_IDLE_TIMEOUT = 10 * time.Second
+	// Limit of UDP queries processed at once. Excess queries are dropped.
+	DNS_SERVER_MAX_UDP_QUERIES = 256
+)
+
+// DNSServer answers A and AAAA queries of clients using resolver. Queries
+// of other types are answered with NOTIMP, so clients don't cache absence of
+// records which may exist.
+type DNSServer struct {
+	resolver LookupNetIPer
+	logger   *CondLogger
+}
+
+func NewDNSServer(resolver LookupNetIPer, logger *CondLogger) *DNSServer {
+	return &DNSServer{
+		resolver: resolver,
+		logger:   logger,
+	}
+}
+
+// ListenDNS binds UDP and TCP listeners at the same address. If port is
+// zero, TCP listener takes port chosen for UDP.
+func ListenDNS(addr string) (net.PacketConn, net.Listener, error) {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		pc.Close()
+		return nil, nil, err
+	}
+	return pc, l, nil
+}
+
+// Serve handles queries on both listeners until one of them fails
+func (s *DNSServer) Serve(pc net.PacketConn, l net.Listener) error {
+	errs := make(chan error, 2)
+	go func() { errs <- s.ServeUDP(pc) }()
+	go func() { errs <- s.ServeTCP(l) }()
+	err := <-errs
+	pc.Close()
+	l.Close()
+	<-errs
+	return err
+}
+
+func (s *DNSServer) ServeUDP(pc net.PacketConn) error {
+	// Queries don't exceed advertised UDP payload size, longer datagrams
+	// are cut and fail to parse.
+	buf := make([]byte, DNS_SERVER_EDNS_UDP_SIZE)
+	sem := make(chan struct{}, DNS_SERVER_MAX_UDP_QUERIES)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		select {
+		case sem <- struct{}{}:
+		default:
+			s.logger.Debug("Too many queries in flight. Dropping query from %s.", addr)
+			continue
+		}
+		query := bytes.Clone(buf[:n])
+		go func() {
+			defer func() { <-sem }()
+			resp := s.handle(query, true)
+			if resp == nil {
+				return
+			}
+			if _, err := pc.WriteTo(resp, addr); err != nil {
+				s.logger.Debug("Unable to send response to %s: %v", addr, err)
+			}
+		}()
+	}
+}
+
+func (s *DNSServer) ServeTCP(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// serveConn answers queries sent over stream connection one after another
+func (s *DNSServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+	for {
+		conn.SetReadDeadline(time.Now().Add(DNS_SERVER_TCP_IDLE_TIMEOUT))
+		var size [2]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(size[:]))
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+		resp := s.handle(query, false)
+		if resp == nil {
+			return
+		}
+		framed := make([]byte, 2+len(resp))
+		binary.BigEndian.PutUint16(framed, uint16(len(resp)))
+		copy(framed[2:], resp)
+		conn.SetWriteDeadline(time.Now().Add(DNS_SERVER_TCP_IDLE_TIMEOUT))
+		if _, err := conn.Write(framed); err != nil {
+			return
+		}
+	}
+}
+
+// handle produces response to query. Nil means query can't be answered at
+// all and should be dropped.
+func (s *DNSServer) handle(query []byte, udp bool) []byte {
+	var p dnsmessage.Parser
+	hdr, err := p.Start(query)
+	if err != nil || hdr.Response {
+		return nil
+	}
+	respHdr := dnsmessage.Header{
+		ID:                 hdr.ID,
+		Response:           true,
+		OpCode:             hdr.OpCode,
+		RecursionDesired:   hdr.RecursionDesired,
+		RecursionAvailable: true,
+	}
+	if hdr.OpCode != 0 {
+		respHdr.RCode = dnsmessage.RCodeNotImplemented
+		return buildDNSResponse(respHdr, nil, nil, false, 0)
+	}
+	questions, err := p.AllQuestions()
+	if err != nil || len(questions) != 1 {
+		respHdr.RCode = dnsmessage.RCodeFormatError
+		return buildDNSResponse(respHdr, nil, nil, false, 0)
+	}
+	q := questions[0]
+
+	// Look for EDNS0 option which advertises larger UDP payload size
+	var (
+		edns    bool
+		maxSize = DNS_SERVER_UDP_SIZE
+	)
+	if p.SkipAllAnswers() == nil && p.SkipAllAuthorities() == nil {
+		for {
+			rh, err := p.AdditionalHeader()
+			if err != nil {
+				break
+			}
+			if rh.Type == dnsmessage.TypeOPT {
+				edns = true
+				maxSize = max(maxSize, min(int(rh.Class), DNS_SERVER_EDNS_UDP_SIZE))
+			}
+			if p.SkipAdditional() != nil {
+				break
+			}
+		}
+	}
+	if !udp {
+		maxSize = MAX_DNS_MESSAGE
+	}
+
+	var (
+		addrs []netip.Addr
+		ttl   time.Duration
+	)
+	switch {
+	case q.Class != dnsmessage.ClassINET:
+		respHdr.RCode = dnsmessage.RCodeRefused
+	case q.Type == dnsmessage.TypeA || q.Type == dnsmessage.TypeAAAA:
+		addrs, ttl, respHdr.RCode = s.lookup(q)
+	default:
+		respHdr.RCode = dnsmessage.RCodeNotImplemented
+	}
+
+	resp := buildDNSResponse(respHdr, &q, addrs, edns, ttl)
+	if len(resp) > maxSize {
+		respHdr.Truncated = true
+		resp = buildDNSResponse(respHdr, &q, nil, edns, 0)
+	}
+	return resp
+}
+
+// lookup resolves question of A or AAAA type
+func (s *DNSServer) lookup(q dnsmessage.Question) ([]netip.Addr, time.Duration, dnsmessage.RCode) {
+	host := strings.TrimSuffix(q.Name.String(), ".")
+	network, other := "ip4", "ip6"
+	if q.Type == dnsmessage.TypeAAAA {
+		network, other = other, network
+	}
+	ctx, cl := context.WithTimeout(context.Background(), DNS_QUERY_TIMEOUT)
+	defer cl()
+	addrs, ttl, err := lookupTTL(ctx, s.resolver, network, host)
+	if err == nil {
+		if ttl <= 0 {
+			ttl = DNS_SERVER_DEFAULT_TTL
+		}
+		return addrs, ttl, dnsmessage.RCodeSuccess
+	}
+	if !isNotFound(err) {
+		s.logger.Warning("Lookup of %s for %s failed: %v", q.Type, host, err)
+		return nil, 0, dnsmessage.RCodeServerFailure
+	}
+	// Not found error doesn't tell if name is missing or just has no
+	// addresses of this family. Name exists if other family resolves.
+	if _, _, err := lookupTTL(ctx, s.resolver, other, host); err == nil || !isNotFound(err) {
+		return nil, 0, dnsmessage.RCodeSuccess
+	}
+	return nil, 0, dnsmessage.RCodeNameError
+}
+
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+func buildDNSResponse(hdr dnsmessage.Header, q *dnsmessage.Question, addrs []netip.Addr, edns bool, ttl time.Duration) []byte {
+	b := dnsmessage.NewBuilder(make([]byte, 0, DNS_SERVER_UDP_SIZE), hdr)
+	b.EnableCompression()
+	b.StartQuestions()
+	if q != nil {
+		b.Question(*q)
+	}
+	b.StartAnswers()
+	ttlSecs := uint32((ttl + time.Second - 1) / time.Second)
+	for _, addr := range addrs {
+		rh := dnsmessage.ResourceHeader{
+			Name:  q.Name,
+			Class: dnsmessage.ClassINET,
+			TTL:   ttlSecs,
+		}
+		addr = addr.Unmap()
+		switch {
+		case addr.Is4() && q.Type == dnsmessage.TypeA:
+			b.AResource(rh, dnsmessage.AResource{A: addr.As4()})
+		case addr.Is6() && q.Type == dnsmessage.TypeAAAA:
+			b.AAAAResource(rh, dnsmessage.AAAAResource{AAAA: addr.As16()})
+		}
+	}
+	b.StartAdditionals()
+	if edns {
+		var rh dnsmessage.ResourceHeader
+		rh.SetEDNS0(DNS_SERVER_EDNS_UDP_SIZE, dnsmessage.RCodeSuccess, false)
+		b.OPTResource(rh, dnsmessage.OPTResource{})
+	}
+	resp, _ := b.Finish()
+	return resp
+}
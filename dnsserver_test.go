@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func startDNSServer(t *testing.T, resolver LookupNetIPer) string {
+	t.Helper()
+	pc, l, err := ListenDNS("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go NewDNSServer(resolver, testLogger(t, "DNS     : ")).Serve(pc, l)
+	t.Cleanup(func() {
+		pc.Close()
+		l.Close()
+	})
+	return pc.LocalAddr().String()
+}
+
+func dnsQuery(t *testing.T, network, addr, host string, qtype dnsmessage.Type) dnsmessage.Message {
+	t.Helper()
+	query, err := (&dnsmessage.Message{
+		Header: dnsmessage.Header{ID: 42, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName(host),
+			Type:  qtype,
+			Class: dnsmessage.ClassINET,
+		}},
+	}).Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cl := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cl()
+	dialer := &net.Dialer{}
+	resp, err := exchangeDNS(ctx, func(ctx context.Context) (net.Conn, error) {
+		return dialer.DialContext(ctx, network, addr)
+	}, query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil {
+		t.Fatal(err)
+	}
+	if msg.ID != 42 || !msg.Response || !msg.RecursionAvailable {
+		t.Fatalf("bad response header: %+v", msg.Header)
+	}
+	return msg
+}
+
+func TestDNSServer(t *testing.T) {
+	resolver := &countingResolver{
+		records: map[string][]netip.Addr{
+			"dual.test": {netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("2001:db8::1")},
+			"v4.test":   {netip.MustParseAddr("192.0.2.2")},
+		},
+		ttl: 300 * time.Second,
+	}
+	addr := startDNSServer(t, &familyResolver{resolver})
+
+	for _, network := range []string{"udp", "tcp"} {
+		for _, tc := range []struct {
+			host  string
+			qtype dnsmessage.Type
+			rcode dnsmessage.RCode
+			want  []string
+		}{
+			{"dual.test.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, []string{"192.0.2.1"}},
+			{"dual.test.", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess, []string{"2001:db8::1"}},
+			{"v4.test.", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess, nil},
+			{"missing.test.", dnsmessage.TypeA, dnsmessage.RCodeNameError, nil},
+			{"dual.test.", dnsmessage.TypeMX, dnsmessage.RCodeNotImplemented, nil},
+			{"dual.test.", dnsmessage.TypeTXT, dnsmessage.RCodeNotImplemented, nil},
+			{"dual.test.", dnsmessage.TypeSRV, dnsmessage.RCodeNotImplemented, nil},
+		} {
+			msg := dnsQuery(t, network, addr, tc.host, tc.qtype)
+			if msg.RCode != tc.rcode {
+				t.Errorf("%s %s %s: rcode = %v, want %v", network, tc.host, tc.qtype, msg.RCode, tc.rcode)
+			}
+			var got []string
+			for _, ans := range msg.Answers {
+				switch body := ans.Body.(type) {
+				case *dnsmessage.AResource:
+					got = append(got, netip.AddrFrom4(body.A).String())
+				case *dnsmessage.AAAAResource:
+					got = append(got, netip.AddrFrom16(body.AAAA).String())
+				}
+				if ans.Header.TTL != 300 {
+					t.Errorf("%s %s %s: TTL = %d, want 300", network, tc.host, tc.qtype, ans.Header.TTL)
+				}
+			}
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("%s %s %s: answers = %v, want %v", network, tc.host, tc.qtype, got, tc.want)
+			}
+		}
+	}
+}
+
+func TestDNSServerFailure(t *testing.T) {
+	addr := startDNSServer(t, &countingResolver{err: errors.New("upstream is down")})
+	msg := dnsQuery(t, "udp", addr, "example.test.", dnsmessage.TypeA)
+	if msg.RCode != dnsmessage.RCodeServerFailure {
+		t.Errorf("rcode = %v, want %v", msg.RCode, dnsmessage.RCodeServerFailure)
+	}
+}
+
+func TestDNSServerTruncation(t *testing.T) {
+	var addrs []netip.Addr
+	for i := range 64 {
+		addrs = append(addrs, netip.AddrFrom4([4]byte{192, 0, 2, byte(i)}))
+	}
+	addr := startDNSServer(t, staticResolver{"many.test": addrs})
+	msg := dnsQuery(t, "udp", addr, "many.test.", dnsmessage.TypeA)
+	if !msg.Truncated || len(msg.Answers) != 0 {
+		t.Errorf("UDP response: truncated = %v, %d answers", msg.Truncated, len(msg.Answers))
+	}
+	msg = dnsQuery(t, "tcp", addr, "many.test.", dnsmessage.TypeA)
+	if msg.Truncated || len(msg.Answers) != len(addrs) {
+		t.Errorf("TCP response: truncated = %v, %d answers", msg.Truncated, len(msg.Answers))
+	}
+}
+
+// familyResolver filters answers of wrapped resolver by address family
+type familyResolver struct {
+	next *countingResolver
+}
+
+func (r *familyResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	addrs, _, err := r.LookupNetIPTTL(ctx, network, host)
+	return addrs, err
+}
+
+func (r *familyResolver) LookupNetIPTTL(ctx context.Context, network, host string) ([]netip.Addr, time.Duration, error) {
+	addrs, ttl, err := r.next.LookupNetIPTTL(ctx, network, host)
+	if err != nil {
+		return nil, ttl, err
+	}
+	addrs = slices.DeleteFunc(slices.Clone(addrs), func(addr netip.Addr) bool {
+		return network == "ip4" && !addr.Is4() || network == "ip6" && !addr.Is6()
+	})
+	if len(addrs) == 0 {
+		return nil, ttl, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return addrs, ttl, nil
+}
+
+// gateResolver holds lookups until release is closed
+type gateResolver struct {
+	release  chan struct{}
+	inflight atomic.Int64
+	peak     atomic.Int64
+}
+
+func (r *gateResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	n := r.inflight.Add(1)
+	defer r.inflight.Add(-1)
+	for {
+		peak := r.peak.Load()
+		if n <= peak || r.peak.CompareAndSwap(peak, n) {
+			break
+		}
+	}
+	select {
+	case <-r.release:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return []netip.Addr{netip.MustParseAddr("192.0.2.1")}, nil
+}
+
+func TestDNSServerUDPLimit(t *testing.T) {
+	resolver := &gateResolver{release: make(chan struct{})}
+	addr := startDNSServer(t, resolver)
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for i := 0; i < DNS_SERVER_MAX_UDP_QUERIES+50; i++ {
+		query, _ := (&dnsmessage.Message{
+			Header: dnsmessage.Header{ID: uint16(i)},
+			Questions: []dnsmessage.Question{{
+				Name:  dnsmessage.MustNewName("example.test."),
+				Type:  dnsmessage.TypeA,
+				Class: dnsmessage.ClassINET,
+			}},
+		}).Pack()
+		if _, err := conn.Write(query); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for resolver.inflight.Load() < DNS_SERVER_MAX_UDP_QUERIES && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if peak := resolver.peak.Load(); peak != DNS_SERVER_MAX_UDP_QUERIES {
+		t.Errorf("got %d queries in flight, want %d", peak, DNS_SERVER_MAX_UDP_QUERIES)
+	}
+	close(resolver.release)
+
+	// Server recovers once queries are done
+	if msg := dnsQuery(t, "udp", addr, "example.test.", dnsmessage.TypeA); len(msg.Answers) != 1 {
+		t.Errorf("got answers %v", msg.Answers)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+)
+
+const (
+	EVENT_CREDENTIALS_ROTATED = "credentials_rotated"
+	EVENT_BAN_DETECTED        = "ban_detected"
+	EVENT_AGENT_CHANGED       = "agent_changed"
+	EVENT_BASE_PROXY_CHANGED  = "base_proxy_changed"
+	EVENT_FALLBACK_USED       = "fallback_used"
+	EVENT_FALLBACK_DROPPED    = "fallback_dropped"
+	EVENT_IDENTITY_RETIRED    = "identity_retired"
+	EVENT_HOST_BLOCKED        = "host_blocked"
+	EVENT_RESOLVE_FALLBACK    = "resolve_fallback"
+)
+
+const (
+	EVENT_QUEUE_LEN        = 64
+	EVENT_WEBHOOK_TIMEOUT  = 10 * time.Second
+	EVENT_WEBHOOK_DEADLINE = 2 * time.Minute
+	EVENT_COMMAND_TIMEOUT  = 30 * time.Second
+)
+
+type Event struct {
+	Type string            `json:"type"`
+	Time time.Time         `json:"time"`
+	Data map[string]string `json:"data,omitempty"`
+}
+
+type EventSink interface {
+	HandleEvent(Event) error
+	String() string
+}
+
+type sinkWorker struct {
+	sink   EventSink
+	queue  chan Event
+	logger *CondLogger
+}
+
+func (w *sinkWorker) loop() {
+	for ev := range w.queue {
+		if err := w.sink.HandleEvent(ev); err != nil {
+			w.logger.Error("Delivery of %q event to %s failed: %v", ev.Type, w.sink, err)
+		}
+	}
+}
+
+// EventBus fans out events to sinks. Every sink has its own delivery queue,
+// so slow sink doesn't delay others and emitters never block.
+type EventBus struct {
+	workers []*sinkWorker
+}
+
+var events = &EventBus{}
+
+// AddSink registers sink. It is not safe to call it concurrently with Emit.
+func (b *EventBus) AddSink(sink EventSink, logger *CondLogger) {
+	w := &sinkWorker{
+		sink:   sink,
+		queue:  make(chan Event, EVENT_QUEUE_LEN),
+		logger: logger,
+	}
+	b.workers = append(b.workers, w)
+	go w.loop()
+}
+
+func (b *EventBus) Emit(typ string, data map[string]string) {
+	ev := Event{
+		Type: typ,
+		Time: time.Now(),
+		Data: data,
+	}
+	for _, w := range b.workers {
+		select {
+		case w.queue <- ev:
+		default:
+			w.logger.Warning("Event queue of %s overflow. Dropping %q event.", w.sink, ev.Type)
+		}
+	}
+}
+
+// WebhookSink POSTs events as JSON documents, retrying with backoff.
+type WebhookSink struct {
+	url    string
+	client *http.Client
+}
+
+func NewWebhookSink(url string) *WebhookSink {
+	return &WebhookSink{
+		url: url,
+		client: &http.Client{
+			Timeout: EVENT_WEBHOOK_TIMEOUT,
+		},
+	}
+}
+
+func (s *WebhookSink) String() string {
+	return "webhook " + s.url
+}
+
+func (s *WebhookSink) HandleEvent(ev Event) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	bo := backoff.NewExponentialBackOff()
+	bo.MaxElapsedTime = EVENT_WEBHOOK_DEADLINE
+	return backoff.Retry(func() error {
+		req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+		if err != nil {
+			return backoff.Permanent(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := s.client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("bad webhook response: %s", resp.Status)
+		}
+		return nil
+	}, bo)
+}
+
+// CommandSink executes external command for every event. Event is passed
+// in environment variables HOLA_EVENT, HOLA_EVENT_TIME and HOLA_EVENT_<KEY>
+// for every data item.
+type CommandSink struct {
+	command string
+}
+
+func NewCommandSink(command string) *CommandSink {
+	return &CommandSink{
+		command: command,
+	}
+}
+
+func (s *CommandSink) String() string {
+	return "command " + s.command
+}
+
+func (s *CommandSink) HandleEvent(ev Event) error {
+	ctx, cancel := context.WithTimeout(context.Background(), EVENT_COMMAND_TIMEOUT)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, s.command)
+	cmd.Env = append(os.Environ(),
+		"HOLA_EVENT="+ev.Type,
+		"HOLA_EVENT_TIME="+ev.Time.Format(time.RFC3339),
+	)
+	for k, v := range ev.Data {
+		cmd.Env = append(cmd.Env, "HOLA_EVENT_"+strings.ToUpper(k)+"="+v)
+	}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w; output: %q", err, out)
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// eventRecorder is a sink collecting events for inspection
+type eventRecorder chan Event
+
+func (r eventRecorder) HandleEvent(ev Event) error {
+	r <- ev
+	return nil
+}
+
+func (r eventRecorder) String() string {
+	return "recorder"
+}
+
+// Next waits for event of given type, skipping others.
+func (r eventRecorder) Next(t *testing.T, typ string) Event {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case ev := <-r:
+			if ev.Type == typ {
+				return ev
+			}
+		case <-timeout:
+			t.Fatalf("no %q event emitted", typ)
+		}
+	}
+}
+
+// recordEvents replaces global event bus for duration of test.
+func recordEvents(t *testing.T) eventRecorder {
+	rec := make(eventRecorder, EVENT_QUEUE_LEN)
+	old := events
+	t.Cleanup(func() {
+		events = old
+	})
+	events = &EventBus{}
+	events.AddSink(rec, testLogger(t, "EVENT   : "))
+	return rec
+}
+
+func TestEventBus(t *testing.T) {
+	rec := recordEvents(t)
+	events.Emit(EVENT_BAN_DETECTED, map[string]string{"kind": BAN_KIND_TEMPORARY})
+	ev := rec.Next(t, EVENT_BAN_DETECTED)
+	if ev.Data["kind"] != BAN_KIND_TEMPORARY || ev.Time.IsZero() {
+		t.Errorf("unexpected event: %+v", ev)
+	}
+}
+
+func TestWebhookSinkRetry(t *testing.T) {
+	var calls atomic.Int64
+	received := make(chan Event, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		// First delivery attempt fails
+		if calls.Add(1) == 1 {
+			http.Error(wr, "try later", http.StatusServiceUnavailable)
+			return
+		}
+		if ct := req.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("got content type %q", ct)
+		}
+		var ev Event
+		if err := json.NewDecoder(req.Body).Decode(&ev); err != nil {
+			t.Error(err)
+		}
+		received <- ev
+	}))
+	defer srv.Close()
+
+	err := NewWebhookSink(srv.URL).HandleEvent(Event{
+		Type: EVENT_AGENT_CHANGED,
+		Time: time.Now(),
+		Data: map[string]string{"identity": "0"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := calls.Load(); got != 2 {
+		t.Errorf("webhook was called %d times, want 2", got)
+	}
+	ev := <-received
+	if ev.Type != EVENT_AGENT_CHANGED || ev.Data["identity"] != "0" {
+		t.Errorf("unexpected event delivered: %+v", ev)
+	}
+}
+
+func TestCommandSink(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test requires POSIX shell")
+	}
+	dir := t.TempDir()
+	out := filepath.Join(dir, "env")
+	script := filepath.Join(dir, "hook.sh")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\nenv > '"+out+"'\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	err := NewCommandSink(script).HandleEvent(Event{
+		Type: EVENT_FALLBACK_USED,
+		Time: now,
+		Data: map[string]string{"agent": "zagent2.hola.org"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars := strings.Split(string(env), "\n")
+	for _, want := range []string{
+		"HOLA_EVENT=" + EVENT_FALLBACK_USED,
+		"HOLA_EVENT_TIME=" + now.Format(time.RFC3339),
+		"HOLA_EVENT_AGENT=zagent2.hola.org",
+	} {
+		found := false
+		for _, v := range vars {
+			found = found || v == want
+		}
+		if !found {
+			t.Errorf("%s is not passed to command", want)
+		}
+	}
+
+	err = NewCommandSink(filepath.Join(dir, "missing.sh")).HandleEvent(Event{Type: EVENT_FALLBACK_USED})
+	if err == nil {
+		t.Error("failure of command is not reported")
+	}
+}
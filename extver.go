@@ -57,7 +57,7 @@ func GetExtVer(ctx context.Context,
 	}
 	defer transport.CloseIdleConnections()
 	httpClient := &http.Client{
-		Transport: transport,
+		Transport: apiTransportWrapper(transport),
 	}
 
 	reqURL := (&url.URL{
@@ -89,11 +89,15 @@ func GetExtVer(ctx context.Context,
 		return "", fmt.Errorf("chrome web store: bad status code: %d", resp.StatusCode)
 	}
 
-	reader := io.LimitReader(resp.Body, 64*1024)
+	return parseExtUpdateResponse(resp.Body)
+}
+
+func parseExtUpdateResponse(r io.Reader) (string, error) {
+	reader := io.LimitReader(r, 64*1024)
 	var respData *StoreExtUpdateResponse
 
 	dec := xml.NewDecoder(reader)
-	err = dec.Decode(&respData)
+	err := dec.Decode(&respData)
 	if err != nil {
 		return "", fmt.Errorf("unmarshaling of chrome web store response failed: %w", err)
 	}
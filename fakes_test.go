@@ -0,0 +1,607 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	stdtls "crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	tls "github.com/refraction-networking/utls"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const testAgentKey = "cd123c465901"
+
+// testPKI is a throwaway CA with a single leaf certificate valid for all
+// names used by fake servers.
+type testPKI struct {
+	pool *x509.CertPool
+	cert stdtls.Certificate
+}
+
+func newTestPKI(t testing.TB) *testPKI {
+	t.Helper()
+	caPEM, cert, err := GenerateMockPKI([]string{"client.hola.org", "*.hola.org", "localhost", "127.0.0.1", "::1"}, 2*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(caPEM)
+	return &testPKI{
+		pool: pool,
+		cert: cert,
+	}
+}
+
+func (p *testPKI) startTLS(t testing.TB, handler http.Handler) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(handler)
+	srv.TLS = &stdtls.Config{
+		Certificates: []stdtls.Certificate{p.cert},
+	}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func testLogger(t testing.TB, prefix string) *CondLogger {
+	return NewCondLogger(log.New(testWriter{t}, prefix, log.Lshortfile), DEBUG)
+}
+
+type testWriter struct {
+	t testing.TB
+}
+
+func (w testWriter) Write(p []byte) (int, error) {
+	w.t.Log(strings.TrimRight(string(p), "\n"))
+	return len(p), nil
+}
+
+// setupHolaGlobals points Hola API client to fake servers and restores
+// globals when test is over.
+func setupHolaGlobals(t testing.TB, pki *testPKI, apiURL string, dialer ContextDialer) {
+	oldDialer, oldTLS, oldSNI := baseDialer, tlsConfig, hideSNI
+	oldFallback := FALLBACK_CONF_URLS
+	t.Cleanup(func() {
+		SetHolaAPIURL(DEFAULT_CCGI_URL)
+		UpdateHolaDialer(oldDialer)
+		UpdateHolaTLSConfig(oldTLS)
+		SetHideSNI(oldSNI)
+		FALLBACK_CONF_URLS = oldFallback
+		fbcMux.Lock()
+		cachedFBC = nil
+		fbcMux.Unlock()
+	})
+	SetHolaAPIURL(apiURL + "/client_cgi/")
+	UpdateHolaTLSConfig(&tls.Config{RootCAs: pki.pool})
+	SetHideSNI(true)
+	if dialer != nil {
+		UpdateHolaDialer(dialer)
+	}
+	fbcMux.Lock()
+	cachedFBC = nil
+	fbcMux.Unlock()
+}
+
+// fakeHolaAPI mimics client.hola.org control plane
+type fakeHolaAPI struct {
+	*httptest.Server
+	agentHost string
+	agentPort uint16
+
+	bgInitBlocked   atomic.Bool
+	bgInitPermanent atomic.Bool
+	emptyIPList     atomic.Bool
+	bgInitCalls     atomic.Int64
+	tunnelsCalls    atomic.Int64
+}
+
+func newFakeHolaAPI(t testing.TB, pki *testPKI, agentAddr string) *fakeHolaAPI {
+	host, portStr, err := net.SplitHostPort(agentAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := &fakeHolaAPI{
+		agentHost: host,
+		agentPort: uint16(port),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/client_cgi/vpn_countries.json", func(wr http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(wr).Encode(CountryList{"us", "de", "uk"})
+	})
+	mux.HandleFunc("/client_cgi/background_init", api.backgroundInit)
+	mux.HandleFunc("/client_cgi/zgettunnels", api.zgettunnels)
+	api.Server = pki.startTLS(t, mux)
+	return api
+}
+
+func (api *fakeHolaAPI) backgroundInit(wr http.ResponseWriter, req *http.Request) {
+	api.bgInitCalls.Add(1)
+	if req.Method != http.MethodPost || req.URL.Query().Get("uuid") == "" {
+		http.Error(wr, "bad request", http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(wr).Encode(BgInitResponse{
+		Ver:       "1.0",
+		Key:       12345,
+		Country:   "us",
+		Blocked:   api.bgInitBlocked.Load(),
+		Permanent: api.bgInitPermanent.Load(),
+	})
+}
+
+func (api *fakeHolaAPI) zgettunnels(wr http.ResponseWriter, req *http.Request) {
+	api.tunnelsCalls.Add(1)
+	if req.URL.Query().Get("session_key") != "12345" {
+		http.Error(wr, "bad session key", http.StatusForbidden)
+		return
+	}
+	resp := ZGetTunnelsResponse{
+		AgentKey: testAgentKey,
+		IPList:   map[string]string{},
+		Port: PortMap{
+			Direct:    api.agentPort,
+			Hola:      api.agentPort,
+			Peer:      api.agentPort,
+			Trial:     api.agentPort,
+			TrialPeer: api.agentPort,
+		},
+		Protocol: map[string]string{"zagent1.hola.org": "HTTP"},
+	}
+	if !api.emptyIPList.Load() {
+		resp.IPList["zagent1.hola.org"] = api.agentHost
+	}
+	json.NewEncoder(wr).Encode(resp)
+}
+
+// newFakeFallbackConfServer serves fallback config in the rotated base64
+// form expected by fetchFallbackConfig.
+func newFakeFallbackConfServer(t testing.TB, pki *testPKI, agents []FallbackAgent) *httptest.Server {
+	return newFakeFallbackConfServerTTL(t, pki, agents, time.Hour)
+}
+
+func newFakeFallbackConfServerTTL(t testing.TB, pki *testPKI, agents []FallbackAgent, ttl time.Duration) *httptest.Server {
+	conf, err := json.Marshal(fallbackConfResponse{
+		Agents:    agents,
+		UpdatedAt: time.Now().UnixMilli(),
+		TTL:       ttl.Milliseconds(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc := base64.RawStdEncoding.EncodeToString(conf)
+	rotated := enc[3:] + enc[:3]
+	return pki.startTLS(t, http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		io.WriteString(wr, rotated)
+	}))
+}
+
+var testLoginRE = regexp.MustCompile(`^user-uuid-[0-9a-f]{32}-is_prem-0$`)
+
+// fakeAgent is a TLS proxy mimicking Hola agent behavior
+type fakeAgent struct {
+	*httptest.Server
+	mux        sync.Mutex
+	blocked    map[string]bool
+	rejectAuth atomic.Bool
+	connects   atomic.Int64
+	requests   atomic.Int64
+}
+
+func newFakeAgent(t testing.TB, pki *testPKI) *fakeAgent {
+	a := &fakeAgent{
+		blocked: make(map[string]bool),
+	}
+	a.Server = pki.startTLS(t, a)
+	return a
+}
+
+func (a *fakeAgent) Block(host string) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	a.blocked[host] = true
+}
+
+func (a *fakeAgent) isBlocked(host string) bool {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	return a.blocked[host]
+}
+
+func (a *fakeAgent) authorized(req *http.Request) bool {
+	if a.rejectAuth.Load() {
+		return false
+	}
+	hdr := req.Header.Get("Proxy-Authorization")
+	if hdr == "" {
+		// fallback agents are used anonymously
+		return true
+	}
+	scheme, cred, _ := strings.Cut(hdr, " ")
+	if !strings.EqualFold(scheme, "basic") {
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(cred)
+	if err != nil {
+		return false
+	}
+	login, password, _ := strings.Cut(string(decoded), ":")
+	return testLoginRE.MatchString(login) && password == testAgentKey
+}
+
+func (a *fakeAgent) ServeHTTP(wr http.ResponseWriter, req *http.Request) {
+	if !a.authorized(req) {
+		http.Error(wr, "Proxy Authentication Required", http.StatusProxyAuthRequired)
+		return
+	}
+	if req.Method == http.MethodConnect {
+		a.connects.Add(1)
+		a.handleConnect(wr, req)
+		return
+	}
+	a.requests.Add(1)
+	if a.isBlocked(req.URL.Hostname()) {
+		wr.Header().Set("X-Hola-Error", "Forbidden Host")
+		http.Error(wr, "Forbidden", http.StatusForbidden)
+		return
+	}
+	outreq := req.Clone(req.Context())
+	outreq.RequestURI = ""
+	outreq.Header.Del("Proxy-Authorization")
+	resp, err := http.DefaultTransport.RoundTrip(outreq)
+	if err != nil {
+		http.Error(wr, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	copyHeader(wr.Header(), resp.Header)
+	wr.WriteHeader(resp.StatusCode)
+	io.Copy(wr, resp.Body)
+}
+
+func (a *fakeAgent) handleConnect(wr http.ResponseWriter, req *http.Request) {
+	host, _, err := net.SplitHostPort(req.RequestURI)
+	if err != nil {
+		http.Error(wr, "bad address", http.StatusBadRequest)
+		return
+	}
+	if a.isBlocked(host) {
+		wr.Header().Set("X-Hola-Error", "Forbidden Host")
+		wr.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if net.ParseIP(host) == nil && host != "localhost" {
+		// only literal addresses are reachable in tests
+		http.Error(wr, "no such host", http.StatusBadGateway)
+		return
+	}
+	target, err := net.Dial("tcp", req.RequestURI)
+	if err != nil {
+		http.Error(wr, err.Error(), http.StatusBadGateway)
+		return
+	}
+	conn, rw, err := wr.(http.Hijacker).Hijack()
+	if err != nil {
+		target.Close()
+		return
+	}
+	io.WriteString(conn, "HTTP/1.1 200 OK\r\n\r\n")
+	go func() {
+		io.Copy(target, rw)
+		target.Close()
+	}()
+	io.Copy(conn, target)
+	conn.Close()
+}
+
+// startEchoServer starts TCP server echoing everything back
+func startEchoServer(t testing.TB) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// fakeDoH answers A and AAAA queries from static records
+type fakeDoH struct {
+	*httptest.Server
+	records map[string][]netip.Addr
+	queries atomic.Int64
+}
+
+func newFakeDoH(t testing.TB, pki *testPKI, records map[string][]netip.Addr) *fakeDoH {
+	d := &fakeDoH{
+		records: records,
+	}
+	d.Server = pki.startTLS(t, d)
+	return d
+}
+
+func (d *fakeDoH) ServeHTTP(wr http.ResponseWriter, req *http.Request) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return
+	}
+	packed, err := d.answer(body)
+	if err != nil {
+		http.Error(wr, err.Error(), http.StatusBadRequest)
+		return
+	}
+	wr.Header().Set("Content-Type", "application/dns-message")
+	wr.Write(packed)
+}
+
+func (d *fakeDoH) answer(query []byte) ([]byte, error) {
+	d.queries.Add(1)
+	var msg dnsmessage.Message
+	if err := msg.Unpack(query); err != nil || len(msg.Questions) != 1 {
+		return nil, fmt.Errorf("bad query")
+	}
+	q := msg.Questions[0]
+	resp := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 msg.ID,
+			Response:           true,
+			RecursionDesired:   msg.RecursionDesired,
+			RecursionAvailable: true,
+		},
+		Questions: msg.Questions,
+	}
+	addrs, ok := d.records[strings.TrimSuffix(strings.ToLower(q.Name.String()), ".")]
+	if !ok {
+		resp.RCode = dnsmessage.RCodeNameError
+	}
+	for _, addr := range addrs {
+		hdr := dnsmessage.ResourceHeader{
+			Name:  q.Name,
+			Class: dnsmessage.ClassINET,
+			TTL:   60,
+		}
+		switch {
+		case q.Type == dnsmessage.TypeA && addr.Is4():
+			hdr.Type = dnsmessage.TypeA
+			resp.Answers = append(resp.Answers, dnsmessage.Resource{
+				Header: hdr,
+				Body:   &dnsmessage.AResource{A: addr.As4()},
+			})
+		case q.Type == dnsmessage.TypeAAAA && addr.Is6():
+			hdr.Type = dnsmessage.TypeAAAA
+			resp.Answers = append(resp.Answers, dnsmessage.Resource{
+				Header: hdr,
+				Body:   &dnsmessage.AAAAResource{AAAA: addr.As16()},
+			})
+		}
+	}
+	return resp.Pack()
+}
+
+// ServePlain answers queries over UDP and TCP at the same port, returning
+// its address
+func (d *fakeDoH) ServePlain(t testing.TB) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		buf := make([]byte, MAX_DNS_MESSAGE)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if resp, err := d.answer(buf[:n]); err == nil {
+				pc.WriteTo(resp, addr)
+			}
+		}
+	}()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go d.serveStream(conn)
+		}
+	}()
+	return l.Addr().String()
+}
+
+// ServeDoT answers queries over DNS-over-TLS, returning server address
+func (d *fakeDoH) ServeDoT(t testing.TB, pki *testPKI) string {
+	l, err := stdtls.Listen("tcp", "127.0.0.1:0", &stdtls.Config{
+		Certificates: []stdtls.Certificate{pki.cert},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go d.serveStream(conn)
+		}
+	}()
+	return l.Addr().String()
+}
+
+// serveStream answers length-prefixed queries until connection is closed
+func (d *fakeDoH) serveStream(conn net.Conn) {
+	defer conn.Close()
+	for {
+		var size [2]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return
+		}
+		query := make([]byte, int(size[0])<<8|int(size[1]))
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+		resp, err := d.answer(query)
+		if err != nil {
+			return
+		}
+		conn.Write(append([]byte{byte(len(resp) >> 8), byte(len(resp))}, resp...))
+	}
+}
+
+// ServeDoQ answers queries over DNS-over-QUIC, returning server address
+func (d *fakeDoH) ServeDoQ(t testing.TB, pki *testPKI) string {
+	l, err := quic.ListenAddr("127.0.0.1:0", &stdtls.Config{
+		Certificates: []stdtls.Certificate{pki.cert},
+		NextProtos:   []string{DOQ_ALPN},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			go func() {
+				for {
+					stream, err := conn.AcceptStream(context.Background())
+					if err != nil {
+						return
+					}
+					go func() {
+						defer stream.Close()
+						msg, err := io.ReadAll(stream)
+						if err != nil || len(msg) < 2 || int(msg[0])<<8|int(msg[1]) != len(msg)-2 {
+							stream.CancelWrite(0)
+							return
+						}
+						resp, err := d.answer(msg[2:])
+						if err != nil {
+							stream.CancelWrite(0)
+							return
+						}
+						stream.Write(append([]byte{byte(len(resp) >> 8), byte(len(resp))}, resp...))
+					}()
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// ServeH3 answers queries over DNS-over-HTTP/3, returning endpoint URL
+func (d *fakeDoH) ServeH3(t testing.TB, pki *testPKI) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http3.Server{
+		Handler: d,
+		TLSConfig: http3.ConfigureTLSConfig(&stdtls.Config{
+			Certificates: []stdtls.Certificate{pki.cert},
+		}),
+	}
+	go srv.Serve(pc)
+	t.Cleanup(func() {
+		srv.Close()
+		pc.Close()
+	})
+	return "https://" + pc.LocalAddr().String() + "/dns-query"
+}
+
+func (d *fakeDoH) Resolver(t testing.TB, pki *testPKI) *MessageResolver {
+	return d.ResolverVia(t, pki, nil)
+}
+
+func (d *fakeDoH) ResolverVia(t testing.TB, pki *testPKI, dialer ContextDialer) *MessageResolver {
+	res, err := NewDoHResolver(d.URL+"/dns-query", dialer, &stdtls.Config{RootCAs: pki.pool})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+// connectVia establishes tunnel through HTTP proxy at proxyAddr
+func connectVia(t testing.TB, proxyAddr, target string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		conn.Close()
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		t.Fatalf("CONNECT %s failed: %s", target, resp.Status)
+	}
+	if br.Buffered() > 0 {
+		conn.Close()
+		t.Fatal("unexpected data after CONNECT response")
+	}
+	return conn
+}
+
+func assertEcho(t testing.TB, conn net.Conn, payload []byte) {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(payload))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, payload) {
+		t.Fatalf("echo mismatch: got %q, want %q", buf, payload)
+	}
+}
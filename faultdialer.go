@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	FAULT_LATENCY       = "latency"
+	FAULT_DIAL_FAILURE  = "dial-failure"
+	FAULT_RESET         = "reset"
+	FAULT_PARTIAL_WRITE = "partial-write"
+	FAULT_TLS_FAILURE   = "tls-failure"
+	FAULT_BOGUS_CONNECT = "bogus-connect"
+)
+
+// Bytes served instead of peer's first response. Alert record breaks TLS
+// handshake, malformed status line breaks CONNECT response parsing.
+var (
+	faultTLSAlert      = []byte{0x15, 0x03, 0x03, 0x00, 0x02, 0x02, 0x28}
+	faultBogusResponse = []byte("HTTP/1.1 ??? Injected Fault\r\nX-Fault: bogus-connect\r\n\r\n")
+)
+
+var InjectedFaultError = errors.New("injected fault")
+
+// FaultConfig specifies probabilities of faults injected by FaultDialer
+type FaultConfig struct {
+	Latency      time.Duration
+	DialFailure  float64
+	Reset        float64
+	PartialWrite float64
+	TLSFailure   float64
+	BogusConnect float64
+}
+
+// ParseFaultConfig parses comma-separated list of fault=value pairs, e.g.
+// "latency=200ms,reset=0.01,bogus-connect=0.1"
+func ParseFaultConfig(spec string) (*FaultConfig, error) {
+	cfg := &FaultConfig{}
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("bad fault specification %q: expected name=value", item)
+		}
+		if name == FAULT_LATENCY {
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return nil, fmt.Errorf("bad fault latency %q: %w", value, err)
+			}
+			cfg.Latency = d
+			continue
+		}
+		var dst *float64
+		switch name {
+		case FAULT_DIAL_FAILURE:
+			dst = &cfg.DialFailure
+		case FAULT_RESET:
+			dst = &cfg.Reset
+		case FAULT_PARTIAL_WRITE:
+			dst = &cfg.PartialWrite
+		case FAULT_TLS_FAILURE:
+			dst = &cfg.TLSFailure
+		case FAULT_BOGUS_CONNECT:
+			dst = &cfg.BogusConnect
+		default:
+			return nil, fmt.Errorf("unknown fault %q", name)
+		}
+		p, err := strconv.ParseFloat(value, 64)
+		if err != nil || p < 0 || p > 1 {
+			return nil, fmt.Errorf("bad probability %q of fault %s: should be in range [0, 1]", value, name)
+		}
+		*dst = p
+	}
+	return cfg, nil
+}
+
+func (c *FaultConfig) String() string {
+	return fmt.Sprintf("%s=%v,%s=%g,%s=%g,%s=%g,%s=%g,%s=%g",
+		FAULT_LATENCY, c.Latency,
+		FAULT_DIAL_FAILURE, c.DialFailure,
+		FAULT_RESET, c.Reset,
+		FAULT_PARTIAL_WRITE, c.PartialWrite,
+		FAULT_TLS_FAILURE, c.TLSFailure,
+		FAULT_BOGUS_CONNECT, c.BogusConnect)
+}
+
+// FaultDialer wraps ContextDialer and injects network faults into dialed
+// connections. It is meant for debugging of recovery paths and should be
+// placed beneath dialers speaking TLS or CONNECT.
+type FaultDialer struct {
+	cfg    FaultConfig
+	next   ContextDialer
+	logger *CondLogger
+	roll   func() float64
+}
+
+func NewFaultDialer(cfg *FaultConfig, next ContextDialer, logger *CondLogger) *FaultDialer {
+	return &FaultDialer{
+		cfg:    *cfg,
+		next:   next,
+		logger: logger,
+		roll:   rand.New(RandomSource).Float64,
+	}
+}
+
+func (d *FaultDialer) hit(p float64) bool {
+	return p > 0 && d.roll() < p
+}
+
+func (d *FaultDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if d.cfg.Latency > 0 {
+		select {
+		case <-time.After(d.cfg.Latency):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if d.hit(d.cfg.DialFailure) {
+		d.logger.Debug("Injecting dial failure for %s", address)
+		return nil, &net.OpError{Op: "dial", Net: network, Err: fmt.Errorf("%w: %w", InjectedFaultError, syscall.ECONNREFUSED)}
+	}
+	conn, err := d.next.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	fc := &faultConn{
+		Conn:    conn,
+		dialer:  d,
+		address: address,
+	}
+	switch {
+	case d.hit(d.cfg.TLSFailure):
+		d.logger.Debug("Injecting TLS handshake failure for %s", address)
+		fc.fake = faultTLSAlert
+	case d.hit(d.cfg.BogusConnect):
+		d.logger.Debug("Injecting bogus CONNECT response for %s", address)
+		fc.fake = faultBogusResponse
+	}
+	return fc, nil
+}
+
+func (d *FaultDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+type faultConn struct {
+	net.Conn
+	dialer  *FaultDialer
+	address string
+	mux     sync.Mutex
+	fake    []byte
+}
+
+func (c *faultConn) reset(op string) error {
+	c.dialer.logger.Debug("Injecting connection reset on %s to %s", op, c.address)
+	c.Conn.Close()
+	return &net.OpError{
+		Op:  op,
+		Net: "tcp",
+		Err: fmt.Errorf("%w: %w", InjectedFaultError, syscall.ECONNRESET),
+	}
+}
+
+func (c *faultConn) Read(b []byte) (int, error) {
+	c.mux.Lock()
+	if c.fake != nil {
+		n := copy(b, c.fake)
+		c.fake = c.fake[n:]
+		if len(c.fake) == 0 {
+			// Peer appears to hang up right after its bogus response
+			c.fake = []byte{}
+			c.Conn.Close()
+		}
+		c.mux.Unlock()
+		if n == 0 {
+			return 0, io.EOF
+		}
+		return n, nil
+	}
+	c.mux.Unlock()
+	if c.dialer.hit(c.dialer.cfg.Reset) {
+		return 0, c.reset("read")
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *faultConn) Write(b []byte) (int, error) {
+	if c.dialer.hit(c.dialer.cfg.Reset) {
+		return 0, c.reset("write")
+	}
+	if len(b) > 1 && c.dialer.hit(c.dialer.cfg.PartialWrite) {
+		c.dialer.logger.Debug("Injecting partial write to %s", c.address)
+		n, err := c.Conn.Write(b[:len(b)/2])
+		if err != nil {
+			return n, err
+		}
+		return n, io.ErrShortWrite
+	}
+	return c.Conn.Write(b)
+}
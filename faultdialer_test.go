@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestFaultDialer(t *testing.T, cfg FaultConfig) *FaultDialer {
+	return NewFaultDialer(&cfg, &net.Dialer{}, testLogger(t, "FAULT   : "))
+}
+
+func TestParseFaultConfig(t *testing.T) {
+	cfg, err := ParseFaultConfig("latency=150ms, reset=0.25,partial-write=1,tls-failure=0,bogus-connect=0.5,dial-failure=0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := FaultConfig{
+		Latency:      150 * time.Millisecond,
+		DialFailure:  0.1,
+		Reset:        0.25,
+		PartialWrite: 1,
+		BogusConnect: 0.5,
+	}
+	if *cfg != want {
+		t.Errorf("got %+v, want %+v", *cfg, want)
+	}
+	for _, spec := range []string{"reset", "reset=2", "reset=-0.1", "latency=fast", "flood=0.5"} {
+		if _, err := ParseFaultConfig(spec); err == nil {
+			t.Errorf("spec %q accepted", spec)
+		}
+	}
+}
+
+func TestFaultDialerTLSFailure(t *testing.T) {
+	pki := newTestPKI(t)
+	agent := newFakeAgent(t, pki)
+	target := startEchoServer(t)
+	dial := func(faults FaultConfig) (net.Conn, error) {
+		return NewProxyDialer(agent.Listener.Addr().String(), "zagent1.hola.org", pki.pool, nil, true, 0,
+			newTestFaultDialer(t, faults)).DialContext(context.Background(), "tcp", target)
+	}
+
+	conn, err := dial(FaultConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	if _, err := dial(FaultConfig{TLSFailure: 1}); err == nil {
+		t.Fatal("handshake succeeded despite injected failure")
+	}
+}
+
+func TestFaultDialerBogusConnect(t *testing.T) {
+	agent := httptest.NewServer(&fakeAgent{blocked: make(map[string]bool)})
+	defer agent.Close()
+	d := NewProxyDialer(agent.Listener.Addr().String(), "", nil, nil, false, 0,
+		newTestFaultDialer(t, FaultConfig{BogusConnect: 1}))
+	_, err := d.DialContext(context.Background(), "tcp", startEchoServer(t))
+	if err == nil {
+		t.Fatal("bogus CONNECT response accepted")
+	}
+}
+
+func TestFaultDialerConnFaults(t *testing.T) {
+	target := startEchoServer(t)
+
+	conn, err := newTestFaultDialer(t, FaultConfig{PartialWrite: 1}).Dial("tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := conn.Write([]byte("0123456789"))
+	if n != 5 || !errors.Is(err, io.ErrShortWrite) {
+		t.Errorf("got n=%d, err=%v; want partial write", n, err)
+	}
+	conn.Close()
+
+	conn, err = newTestFaultDialer(t, FaultConfig{Reset: 1}).Dial("tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte("ping")); !errors.Is(err, InjectedFaultError) {
+		t.Errorf("got error %v, want %v", err, InjectedFaultError)
+	}
+	conn.Close()
+}
+
+func TestFaultDialerHolaAPI(t *testing.T) {
+	env := newTestEnv(t)
+	setupHolaGlobals(t, env.pki, env.api.URL, newTestFaultDialer(t, FaultConfig{DialFailure: 1}))
+	_, err := VPNCountries(context.Background(), httpClientWithProxy(nil))
+	if !errors.Is(err, InjectedFaultError) {
+		t.Errorf("got error %v, want %v", err, InjectedFaultError)
+	}
+}
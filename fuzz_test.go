@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func rotateFallbackConfig(data []byte) []byte {
+	enc := []byte(base64.RawStdEncoding.EncodeToString(data))
+	if len(enc) < 3 {
+		return enc
+	}
+	return append(append([]byte{}, enc[3:]...), enc[:3]...)
+}
+
+func FuzzParseResponse(f *testing.F) {
+	f.Add([]byte("HTTP/1.1 200 OK\r\n\r\n"), false)
+	f.Add([]byte("HTTP/1.1 200 Connection established\r\nServer: zagent\r\n\r\ntunnel data"), true)
+	f.Add([]byte("HTTP/1.1 403 Forbidden\r\nX-Hola-Error: Forbidden Host\r\nContent-Length: 0\r\n\r\n"), false)
+	f.Add([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"), true)
+	f.Add([]byte("HTTP/1.1 200 OK\r\n"), false)
+	f.Add([]byte("\r\n\r\n"), false)
+	f.Add([]byte{}, false)
+	f.Fuzz(func(t *testing.T, data []byte, oneByte bool) {
+		var r io.Reader = bytes.NewReader(data)
+		if oneByte {
+			r = iotest.OneByteReader(r)
+		}
+		resp, br, err := parseResponse(r, &http.Request{Method: PROXY_CONNECT_METHOD})
+		if err != nil {
+			return
+		}
+		if resp.StatusCode < 0 {
+			t.Errorf("negative status code %d", resp.StatusCode)
+		}
+		rest, err := io.ReadAll(br)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasSuffix(data, rest) {
+			t.Errorf("bytes past header are lost: got %q from %q", rest, data)
+		}
+	})
+}
+
+func TestParseResponseLimits(t *testing.T) {
+	huge := "HTTP/1.1 200 OK\r\nX-Pad: " + strings.Repeat("a", MAX_RESPONSE_HEADER_SIZE) + "\r\n\r\n"
+	if _, _, err := parseResponse(strings.NewReader(huge), nil); !errors.Is(err, ResponseHeaderTooLongError) {
+		t.Errorf("got error %v, want %v", err, ResponseHeaderTooLongError)
+	}
+	if _, _, err := parseResponse(strings.NewReader("HTTP/1.1 200 OK\r\nServer: zag"), nil); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("got error %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func FuzzFallbackConfigUnmarshalJSON(f *testing.F) {
+	f.Add([]byte(`{"agents":[{"name":"zagent1","ip":"1.2.3.4","port":22222}],"updated_ts":1700000000000,"ttl_ms":3600000}`))
+	f.Add([]byte(`{"agents":null,"updated_ts":-1,"ttl_ms":9223372036854775807}`))
+	f.Add([]byte(`{"agents":[{"port":70000}]}`))
+	f.Add([]byte(`[]`))
+	f.Add([]byte(`null`))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fbc := &FallbackConfig{}
+		if err := json.Unmarshal(data, fbc); err != nil {
+			return
+		}
+		fbc.Expired()
+		fbc.ShuffleAgents()
+		for _, agent := range fbc.Clone().Agents {
+			agent.ToProxy()
+			agent.NetAddr()
+		}
+	})
+}
+
+func FuzzDecodeFallbackConfig(f *testing.F) {
+	f.Add(rotateFallbackConfig([]byte(`{"agents":[{"name":"zagent1","ip":"1.2.3.4","port":22222}],"updated_ts":1,"ttl_ms":1}`)))
+	f.Add(rotateFallbackConfig([]byte(`{}`)))
+	f.Add([]byte("abc"))
+	f.Add([]byte("====="))
+	f.Add([]byte{0xff, 0xfe, 0x00, 0x01})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fbc, err := decodeFallbackConfig(data)
+		if err == nil && fbc == nil {
+			t.Error("nil config returned without error")
+		}
+	})
+}
+
+func FuzzParseExtUpdateResponse(f *testing.F) {
+	f.Add([]byte(`<?xml version="1.0" encoding="UTF-8"?><gupdate xmlns="http://www.google.com/update2/response" protocol="2.0">` +
+		`<app appid="gkojfkhlekighikafcpjkiklfbnlmeio" status="ok"><updatecheck version="1.2.3" status="ok"/></app></gupdate>`))
+	f.Add([]byte(`<gupdate><app status="error-unknownApplication"/></gupdate>`))
+	f.Add([]byte(`<gupdate></gupdate>`))
+	f.Add([]byte(`<other/>`))
+	f.Add([]byte(`<gupdate><app><updatecheck version=`))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		ver, err := parseExtUpdateResponse(bytes.NewReader(data))
+		if err == nil && ver == "" {
+			t.Error("empty version returned without error")
+		}
+	})
+}
+
+func FuzzCSVArgSet(f *testing.F) {
+	f.Add("https://cloudflare-dns.com/dns-query,https://dns.google/dns-query")
+	f.Add(`"a,b", c`)
+	f.Add("")
+	f.Add(`"unterminated`)
+	f.Add("a\nb")
+	f.Fuzz(func(t *testing.T, line string) {
+		arg := &CSVArg{}
+		if err := arg.Set(line); err != nil {
+			return
+		}
+		again := &CSVArg{}
+		if err := again.Set(arg.String()); err != nil {
+			t.Fatalf("can't parse own representation %q: %v", arg.String(), err)
+		}
+	})
+}
+
+func FuzzGetEndpoint(f *testing.F) {
+	f.Add([]byte(`{"ip_list":{"zagent1.hola.org":"1.2.3.4"},"port":{"direct":22222,"peer":22223,"trial":22225,"trial_peer":22226}}`),
+		"direct", false, "")
+	f.Add([]byte(`{"ip_list":{"zagent1.hola.org":"1.2.3.4"}}`), "peer", true, "hola")
+	f.Add([]byte(`{"ip_list":{"zagent1.hola.org":"1.2.3.4"}}`), "skip", false, "0x10000")
+	f.Add([]byte(`{"ip_list":{}}`), "direct", false, "443")
+	f.Add([]byte(`null`), "lum", false, "")
+	f.Fuzz(func(t *testing.T, data []byte, typ string, trial bool, forcePort string) {
+		var tunnels *ZGetTunnelsResponse
+		if err := json.Unmarshal(data, &tunnels); err != nil {
+			return
+		}
+		endpoint, err := get_endpoint(tunnels, typ, trial, forcePort)
+		if err != nil {
+			return
+		}
+		endpoint.URL()
+		endpoint.NetAddr()
+	})
+}
+
+func TestVerifyPeerCertificatesEmpty(t *testing.T) {
+	if err := verifyPeerCertificates(nil, "example.com", nil); !errors.Is(err, NoPeerCertificatesError) {
+		t.Errorf("got error %v, want %v", err, NoPeerCertificatesError)
+	}
+}
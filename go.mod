@@ -7,7 +7,9 @@ require (
 	github.com/cenkalti/backoff/v4 v4.3.0
 	github.com/google/uuid v1.6.0
 	github.com/hashicorp/go-multierror v1.1.1
+	github.com/miekg/dns v1.1.68
 	github.com/ncruces/go-dns v1.2.7
+	github.com/quic-go/quic-go v0.55.0
 	github.com/refraction-networking/utls v1.8.0
 	golang.org/x/net v0.44.0
 )
@@ -16,6 +18,11 @@ require (
 	github.com/andybalholm/brotli v1.2.0 // indirect
 	github.com/hashicorp/errwrap v1.1.0 // indirect
 	github.com/klauspost/compress v1.18.0 // indirect
+	github.com/quic-go/qpack v0.5.1 // indirect
 	golang.org/x/crypto v0.42.0 // indirect
+	golang.org/x/mod v0.27.0 // indirect
+	golang.org/x/sync v0.17.0 // indirect
 	golang.org/x/sys v0.36.0 // indirect
+	golang.org/x/text v0.29.0 // indirect
+	golang.org/x/tools v0.36.0 // indirect
 )
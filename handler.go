@@ -1,7 +1,12 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"strings"
@@ -10,35 +15,106 @@ import (
 
 const BAD_REQ_MSG = "Bad Request\n"
 
+// Maximal size of request body kept in memory for retry of plain HTTP
+// request to blocked host
+const MAX_RESCUE_BODY = 1024 * 1024
+
 type AuthProvider func() string
 
+// Upstream is a way out through the Hola network: dialers and credentials
+// which have to be used together.
+type Upstream struct {
+	// Name uniquely identifies upstream. It is also used as a key for
+	// pooling of plain HTTP connections, so it has to be a valid hostname.
+	Name          string
+	Endpoint      *Endpoint
+	Dialer        ContextDialer
+	RequestDialer ContextDialer
+	Auth          AuthProvider
+}
+
+type UpstreamSelector interface {
+	SelectUpstream(req *http.Request) (*Upstream, error)
+}
+
+// StaticUpstream routes all requests through itself
+type StaticUpstream Upstream
+
+func (s *StaticUpstream) SelectUpstream(_ *http.Request) (*Upstream, error) {
+	return (*Upstream)(s), nil
+}
+
+type upstreamKey struct{}
+
+func withUpstream(ctx context.Context, up *Upstream) context.Context {
+	return context.WithValue(ctx, upstreamKey{}, up)
+}
+
+func upstreamFromContext(ctx context.Context) (*Upstream, bool) {
+	up, ok := ctx.Value(upstreamKey{}).(*Upstream)
+	return up, ok
+}
+
+// routedDialer dials through the upstream selected for request and carried
+// by the dial context.
+type routedDialer struct {
+	plain bool
+}
+
+func (d routedDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	up, ok := upstreamFromContext(ctx)
+	if !ok {
+		return nil, errors.New("no upstream selected for connection")
+	}
+	if d.plain {
+		return up.RequestDialer.DialContext(ctx, network, address)
+	}
+	return up.Dialer.DialContext(ctx, network, address)
+}
+
+func (d routedDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
 type ProxyHandler struct {
 	logger        *CondLogger
 	dialer        ContextDialer
 	httptransport http.RoundTripper
-	auth          AuthProvider
+	upstreams     UpstreamSelector
+	resolver      LookupNetIPer
+	blocked       *BlockedHosts
+	family        string
+	limits        TunnelLimits
 }
 
-func NewProxyHandler(dialer, requestDialer ContextDialer, auth AuthProvider, resolver LookupNetIPer, logger *CondLogger) *ProxyHandler {
-	dialer = NewRetryDialer(dialer, resolver, logger)
+func NewProxyHandler(upstreams UpstreamSelector, resolver LookupNetIPer, blocked *BlockedHosts, family string, limits TunnelLimits, logger *CondLogger) *ProxyHandler {
+	dialer := NewRetryDialer(routedDialer{}, resolver, blocked, family, logger)
 	httptransport := &http.Transport{
-		Proxy: func(_ *http.Request) (*url.URL, error) {
+		Proxy: func(req *http.Request) (*url.URL, error) {
+			up, ok := upstreamFromContext(req.Context())
+			if !ok {
+				return nil, errors.New("no upstream selected for request")
+			}
 			return &url.URL{
 				Scheme: "http",
-				Host:   "void",
+				Host:   up.Name,
 			}, nil
 		},
 		MaxIdleConns:          100,
 		IdleConnTimeout:       90 * time.Second,
 		TLSHandshakeTimeout:   10 * time.Second,
 		ExpectContinueTimeout: 1 * time.Second,
-		DialContext:           requestDialer.DialContext,
+		DialContext:           routedDialer{plain: true}.DialContext,
 	}
 	return &ProxyHandler{
 		logger:        logger,
 		dialer:        dialer,
-		auth:          auth,
+		upstreams:     upstreams,
+		resolver:      resolver,
+		blocked:       blocked,
+		family:        family,
 		httptransport: httptransport,
+		limits:        limits,
 	}
 }
 
@@ -64,12 +140,12 @@ func (s *ProxyHandler) HandleTunnel(wr http.ResponseWriter, req *http.Request) {
 		// Inform client connection is built
 		fmt.Fprintf(localconn, "HTTP/%d.%d 200 OK\r\n\r\n", req.ProtoMajor, req.ProtoMinor)
 
-		proxy(req.Context(), localconn, conn)
+		proxy(req.Context(), localconn, conn, s.limits)
 	} else if req.ProtoMajor == 2 {
 		wr.Header()["Date"] = nil
 		wr.WriteHeader(http.StatusOK)
 		flush(wr)
-		proxyh2(req.Context(), req.Body, wr, conn)
+		proxyh2(req.Context(), req.Body, wr, conn, s.limits)
 	} else {
 		s.logger.Error("Unsupported protocol version: %s", req.Proto)
 		http.Error(wr, "Unsupported protocol version.", http.StatusBadRequest)
@@ -84,8 +160,40 @@ func (s *ProxyHandler) HandleRequest(wr http.ResponseWriter, req *http.Request)
 		req.URL.Host = req.Host
 	}
 	delHopHeaders(req.Header)
-	req.Header.Add("Proxy-Authorization", s.auth())
-	resp, err := s.httptransport.RoundTrip(req)
+	up, _ := upstreamFromContext(req.Context())
+	req.Header.Set("Proxy-Authorization", up.Auth())
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody && req.ContentLength > 0 && req.ContentLength <= MAX_RESCUE_BODY {
+		// Keep body for retry in case host is blocked by upstream
+		var err error
+		body, err = io.ReadAll(io.LimitReader(req.Body, req.ContentLength))
+		req.Body.Close()
+		if err != nil {
+			s.logger.Error("Can't read request body: %v", err)
+			http.Error(wr, "Can't read request body", http.StatusBadRequest)
+			return
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	replayable := body != nil || req.ContentLength == 0
+	var (
+		resp *http.Response
+		err  error
+	)
+	if replayable && s.blocked != nil && s.blocked.Blocked(req.URL.Hostname()) {
+		s.logger.Debug("Destination %s is known to be blocked by upstream. Using resolve&forward workaround.", req.URL.Host)
+		resp, err = s.rescueRequest(req, body)
+	} else {
+		resp, err = s.httptransport.RoundTrip(req)
+		if err == nil && isBlockedResponse(resp) && replayable {
+			resp.Body.Close()
+			s.logger.Info("Destination %s blocked by upstream. Rescuing it with resolve&forward workaround.", req.URL.Host)
+			if s.blocked != nil {
+				s.blocked.Learn(req.URL.Hostname())
+			}
+			resp, err = s.rescueRequest(req, body)
+		}
+	}
 	if err != nil {
 		s.logger.Error("HTTP fetch error: %v", err)
 		http.Error(wr, "Server Error", http.StatusInternalServerError)
@@ -100,6 +208,62 @@ func (s *ProxyHandler) HandleRequest(wr http.ResponseWriter, req *http.Request)
 	copyBody(wr, resp.Body)
 }
 
+func isBlockedResponse(resp *http.Response) bool {
+	return resp.StatusCode == http.StatusForbidden && resp.Header.Get("X-Hola-Error") == "Forbidden Host"
+}
+
+// rescueRequest resends request to resolved addresses of blocked host,
+// keeping original Host header.
+func (s *ProxyHandler) rescueRequest(req *http.Request, body []byte) (*http.Response, error) {
+	host := req.URL.Hostname()
+	port := req.URL.Port()
+	if port == "" {
+		port = "80"
+	}
+	resolved, err := s.resolver.LookupNetIP(req.Context(), "ip", host)
+	if err != nil {
+		return nil, fmt.Errorf("rescue failed on address lookup: %w", err)
+	}
+	if len(resolved) == 0 {
+		return nil, fmt.Errorf("rescue failed: no addresses found for %s", host)
+	}
+	origHost := req.Host
+	if origHost == "" {
+		origHost = req.URL.Host
+	}
+	for _, ip := range sortAddrs(resolved, s.family) {
+		outreq := redirectedRequest(req, net.JoinHostPort(ip.Unmap().String(), port), origHost, body)
+		resp, err := s.httptransport.RoundTrip(outreq)
+		if err != nil {
+			s.logger.Debug("Rescue of %s via %s failed: %v", origHost, ip, err)
+			continue
+		}
+		if isBlockedResponse(resp) {
+			resp.Body.Close()
+			s.logger.Debug("Rescue of %s via %s failed: address is blocked too", origHost, ip)
+			continue
+		}
+		return resp, nil
+	}
+	return nil, fmt.Errorf("all addresses of %s are unreachable or blocked", host)
+}
+
+// redirectedRequest makes copy of request addressed to addr, with host
+// header set to host
+func redirectedRequest(req *http.Request, addr, host string, body []byte) *http.Request {
+	outreq := req.Clone(req.Context())
+	outreq.URL.Host = addr
+	// Otherwise proxy request line is built from Host, but it has to carry
+	// address while Host header carries original name.
+	outreq.URL.Opaque = "//" + addr + outreq.URL.EscapedPath()
+	outreq.Host = host
+	outreq.Body = http.NoBody
+	if body != nil {
+		outreq.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	return outreq
+}
+
 func (s *ProxyHandler) ServeHTTP(wr http.ResponseWriter, req *http.Request) {
 	s.logger.Info("Request: %v %v %v %v", req.RemoteAddr, req.Proto, req.Method, req.URL)
 
@@ -110,6 +274,14 @@ func (s *ProxyHandler) ServeHTTP(wr http.ResponseWriter, req *http.Request) {
 		return
 	}
 	delHopHeaders(req.Header)
+	up, err := s.upstreams.SelectUpstream(req)
+	if err != nil {
+		s.logger.Error("Can't select upstream for request: %v", err)
+		http.Error(wr, "Can't select upstream", http.StatusServiceUnavailable)
+		return
+	}
+	s.logger.Debug("Request from %v is routed via %s", req.RemoteAddr, up.Name)
+	req = req.WithContext(withUpstream(req.Context(), up))
 	if isConnect {
 		s.HandleTunnel(wr, req)
 	} else {
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRedirectedRequest(t *testing.T) {
+	req := httptest.NewRequest("POST", "http://blocked.test:8080/path%2Fx?q=1", strings.NewReader("payload"))
+	outreq := redirectedRequest(req, "192.0.2.1:8080", req.Host, []byte("payload"))
+	buf := &bytes.Buffer{}
+	if err := outreq.WriteProxy(buf); err != nil {
+		t.Fatal(err)
+	}
+	line, _ := buf.ReadString('\n')
+	if want := "POST http://192.0.2.1:8080/path%2Fx?q=1 HTTP/1.1\r\n"; line != want {
+		t.Errorf("got request line %q, want %q", line, want)
+	}
+	parsed, err := http.ReadRequest(bufio.NewReader(io.MultiReader(strings.NewReader(line), buf)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host := parsed.Header.Get("Host"); host != "" {
+		t.Errorf("unexpected Host header copy %q", host)
+	}
+	body, _ := io.ReadAll(parsed.Body)
+	if string(body) != "payload" {
+		t.Errorf("got body %q, want %q", body, "payload")
+	}
+}
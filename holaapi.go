@@ -9,11 +9,13 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"net"
 	"net/http"
 	"net/url"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -28,11 +30,28 @@ import (
 
 const EXT_BROWSER = "chrome"
 const PRODUCT = "cws"
-const CCGI_URL = "https://client.hola.org/client_cgi/"
-const VPN_COUNTRIES_URL = CCGI_URL + "vpn_countries.json"
-const BG_INIT_URL = CCGI_URL + "background_init"
-const ZGETTUNNELS_URL = CCGI_URL + "zgettunnels"
+const DEFAULT_CCGI_URL = "https://client.hola.org/client_cgi/"
 const AGENT_SUFFIX = ".hola.org"
+const MAX_API_RESPONSE_SIZE = 4 * 1024 * 1024
+
+var (
+	CCGI_URL          string
+	VPN_COUNTRIES_URL string
+	BG_INIT_URL       string
+	ZGETTUNNELS_URL   string
+)
+
+func init() {
+	SetHolaAPIURL(DEFAULT_CCGI_URL)
+}
+
+// SetHolaAPIURL changes base URL of Hola client API methods
+func SetHolaAPIURL(ccgiURL string) {
+	CCGI_URL = ccgiURL
+	VPN_COUNTRIES_URL = CCGI_URL + "vpn_countries.json"
+	BG_INIT_URL = CCGI_URL + "background_init"
+	ZGETTUNNELS_URL = CCGI_URL + "zgettunnels"
+}
 
 var FALLBACK_CONF_URLS = []string{
 	"https://www.dropbox.com/s/jemizcvpmf2qb9v/cloud_failover.conf?dl=1",
@@ -112,11 +131,16 @@ func (c *FallbackConfig) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+// Expired reports if config is outdated. Replayed config never expires.
 func (c *FallbackConfig) Expired() bool {
-	return time.Now().After(c.UpdatedAt.Add(c.TTL))
+	return !replayingAPI && time.Now().After(c.UpdatedAt.Add(c.TTL))
 }
 
+// ShuffleAgents randomizes order of agents unless config is replayed.
 func (c *FallbackConfig) ShuffleAgents() {
+	if replayingAPI {
+		return
+	}
 	rand.New(RandomSource).Shuffle(len(c.Agents), func(i, j int) {
 		c.Agents[i], c.Agents[j] = c.Agents[j], c.Agents[i]
 	})
@@ -176,16 +200,19 @@ func do_req(ctx context.Context, client *http.Client, method, url string, query,
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close()
 	switch resp.StatusCode {
 	case http.StatusOK, http.StatusCreated, http.StatusAccepted, http.StatusNoContent:
 	default:
 		return nil, errors.New(fmt.Sprintf("Bad HTTP response: %s", resp.Status))
 	}
-	body, err := ioutil.ReadAll(resp.Body)
-	resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, MAX_API_RESPONSE_SIZE+1))
 	if err != nil {
 		return nil, err
 	}
+	if len(body) > MAX_API_RESPONSE_SIZE {
+		return nil, errors.New("API response is too large")
+	}
 	return body, nil
 }
 
@@ -279,11 +306,27 @@ func zgettunnels(ctx context.Context,
 func fetchFallbackConfig(ctx context.Context) (*FallbackConfig, error) {
 	client := httpClientWithProxy(nil)
 	fallbackConfURL := FALLBACK_CONF_URLS[rand.New(RandomSource).Intn(len(FALLBACK_CONF_URLS))]
-	confRaw, err := do_req(ctx, client, "", fallbackConfURL, nil, nil)
+	confRaw, err := do_req(withCassetteKind(ctx, CASSETTE_KIND_FALLBACK_CONF), client, "", fallbackConfURL, nil, nil)
 	if err != nil {
 		return nil, err
 	}
 
+	fbc, err := decodeFallbackConfig(confRaw)
+	if err != nil {
+		return nil, err
+	}
+
+	if fbc.Expired() {
+		return nil, errors.New("fetched expired fallback config")
+	}
+
+	fbc.ShuffleAgents()
+	return fbc, nil
+}
+
+// decodeFallbackConfig undoes rotation and base64 encoding of fallback
+// config body
+func decodeFallbackConfig(confRaw []byte) (*FallbackConfig, error) {
 	l := len(confRaw)
 	if l < 4 {
 		return nil, errors.New("bad response length from fallback conf URL")
@@ -298,16 +341,10 @@ func fetchFallbackConfig(ctx context.Context) (*FallbackConfig, error) {
 	jdec := json.NewDecoder(b64dec)
 	fbc := &FallbackConfig{}
 
-	err = jdec.Decode(fbc)
+	err := jdec.Decode(fbc)
 	if err != nil {
 		return nil, err
 	}
-
-	if fbc.Expired() {
-		return nil, errors.New("fetched expired fallback config")
-	}
-
-	fbc.ShuffleAgents()
 	return fbc, nil
 }
 
@@ -338,6 +375,32 @@ func GetFallbackProxies(ctx context.Context) (*FallbackConfig, error) {
 	return fbc.Clone(), nil
 }
 
+// DropFallbackAgent excludes agent from cached fallback config, so
+// following transactions switch to remaining agents until config is
+// refreshed.
+func DropFallbackAgent(agent *FallbackAgent) {
+	fbcMux.Lock()
+	defer fbcMux.Unlock()
+
+	if cachedFBC == nil {
+		return
+	}
+	fbc := cachedFBC.Clone()
+	fbc.Agents = slices.DeleteFunc(fbc.Agents, func(a FallbackAgent) bool {
+		return a == *agent
+	})
+	cachedFBC = fbc
+}
+
+type fallbackAgentKey struct{}
+
+// FallbackAgentFromContext returns fallback agent used by transaction
+// attempt or nil if attempt is direct.
+func FallbackAgentFromContext(ctx context.Context) *FallbackAgent {
+	agent, _ := ctx.Value(fallbackAgentKey{}).(*FallbackAgent)
+	return agent
+}
+
 func Tunnels(ctx context.Context,
 	logger *CondLogger,
 	client *http.Client,
@@ -418,7 +481,7 @@ func httpClientWithProxy(agent *FallbackAgent) *http.Client {
 		rootCAs = tlsConfig.RootCAs
 	}
 	if agent != nil {
-		dialer = NewProxyDialer(agent.NetAddr(), agent.Hostname(), rootCAs, nil, true, dialer)
+		dialer = NewProxyDialer(agent.NetAddr(), agent.Hostname(), rootCAs, nil, true, 0, dialer)
 	}
 	t.DialContext = dialer.DialContext
 	t.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
@@ -430,28 +493,19 @@ func httpClientWithProxy(agent *FallbackAgent) *http.Client {
 		if err != nil {
 			return nil, fmt.Errorf("can't prepare underlying connection for TLS session: %w", err)
 		}
-		var cfg tls.Config
+		cfg := &tls.Config{}
 		if tlsConfig != nil {
-			cfg = *tlsConfig
+			cfg = tlsConfig.Clone()
 		}
 		if !hideSNI {
 			cfg.ServerName = host
 		} else {
 			cfg.InsecureSkipVerify = true
 			cfg.VerifyConnection = func(cs tls.ConnectionState) error {
-				opts := x509.VerifyOptions{
-					DNSName:       host,
-					Intermediates: x509.NewCertPool(),
-					Roots:         cfg.RootCAs,
-				}
-				for _, cert := range cs.PeerCertificates[1:] {
-					opts.Intermediates.AddCert(cert)
-				}
-				_, err := cs.PeerCertificates[0].Verify(opts)
-				return err
+				return verifyPeerCertificates(cs.PeerCertificates, host, cfg.RootCAs)
 			}
 		}
-		tlsConn := tls.UClient(conn, &cfg, tls.HelloAndroid_11_OkHttp)
+		tlsConn := tls.UClient(conn, cfg, tls.HelloAndroid_11_OkHttp)
 		if err := tlsConn.HandshakeContext(ctx); err != nil {
 			conn.Close()
 			return nil, fmt.Errorf("UClient handshake failed: %w", err)
@@ -459,7 +513,7 @@ func httpClientWithProxy(agent *FallbackAgent) *http.Client {
 		return tlsConn, nil
 	}
 	return &http.Client{
-		Transport: t,
+		Transport: apiTransportWrapper(t),
 	}
 }
 
@@ -480,9 +534,13 @@ func EnsureTransaction(ctx context.Context, getFBTimeout time.Duration, txn func
 	}
 
 	for _, agent := range fbc.Agents {
+		events.Emit(EVENT_FALLBACK_USED, map[string]string{
+			"agent": agent.Hostname(),
+			"ip":    agent.IP,
+		})
 		client = httpClientWithProxy(&agent)
 		defer client.CloseIdleConnections()
-		if txn(ctx, client) {
+		if txn(context.WithValue(ctx, fallbackAgentKey{}, &agent), client) {
 			return true, nil
 		}
 	}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hostRules maps names to addresses. Names starting with "*." match any
+// subdomain of the rest of name.
+type hostRules struct {
+	exact    map[string][]netip.Addr
+	wildcard map[string][]netip.Addr
+}
+
+func newHostRules() hostRules {
+	return hostRules{
+		exact:    make(map[string][]netip.Addr),
+		wildcard: make(map[string][]netip.Addr),
+	}
+}
+
+func (r hostRules) add(name string, addr netip.Addr) {
+	name = normalizeHost(name)
+	if suffix, ok := strings.CutPrefix(name, "*."); ok {
+		r.wildcard[suffix] = append(r.wildcard[suffix], addr)
+		return
+	}
+	r.exact[name] = append(r.exact[name], addr)
+}
+
+// lookup finds addresses for host. Exact rule wins, then wildcard with the
+// longest suffix.
+func (r hostRules) lookup(host string) ([]netip.Addr, bool) {
+	if addrs, ok := r.exact[host]; ok {
+		return addrs, true
+	}
+	for domain := host; ; {
+		_, parent, found := strings.Cut(domain, ".")
+		if !found {
+			return nil, false
+		}
+		if addrs, ok := r.wildcard[parent]; ok {
+			return addrs, true
+		}
+		domain = parent
+	}
+}
+
+// parseHosts reads hosts(5) formatted file
+func parseHosts(rd io.Reader) (hostRules, error) {
+	rules := newHostRules()
+	scanner := bufio.NewScanner(rd)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			return rules, fmt.Errorf("line %d: no host names for address %q", lineNum, fields[0])
+		}
+		addr, err := netip.ParseAddr(fields[0])
+		if err != nil {
+			return rules, fmt.Errorf("line %d: %w", lineNum, err)
+		}
+		for _, name := range fields[1:] {
+			rules.add(name, addr)
+		}
+	}
+	return rules, scanner.Err()
+}
+
+// ParseHostOverride parses host override in form name=ip
+func ParseHostOverride(spec string) (string, netip.Addr, error) {
+	name, addrStr, ok := strings.Cut(spec, "=")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" {
+		return "", netip.Addr{}, fmt.Errorf("bad host override %q: expected name=ip", spec)
+	}
+	addr, err := netip.ParseAddr(strings.TrimSpace(addrStr))
+	if err != nil {
+		return "", netip.Addr{}, fmt.Errorf("bad host override %q: %w", spec, err)
+	}
+	return name, addr, nil
+}
+
+// HostsResolver answers from static overrides and hosts file, passing
+// other lookups to next resolver. Overrides take precedence over hosts
+// file.
+type HostsResolver struct {
+	next      LookupNetIPer
+	path      string
+	overrides hostRules
+	mux       sync.RWMutex
+	file      hostRules
+}
+
+// NewHostsResolver creates resolver with hosts file at path. Empty path
+// means no hosts file.
+func NewHostsResolver(next LookupNetIPer, path string) (*HostsResolver, error) {
+	r := &HostsResolver{
+		next:      next,
+		path:      path,
+		overrides: newHostRules(),
+		file:      newHostRules(),
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// AddOverride pins name to address. Has to be called before resolver is
+// put in use.
+func (r *HostsResolver) AddOverride(name string, addr netip.Addr) {
+	r.overrides.add(name, addr)
+}
+
+// Reload rereads hosts file. Previous rules remain in effect if file can't
+// be read.
+func (r *HostsResolver) Reload() error {
+	if r.path == "" {
+		return nil
+	}
+	f, err := os.Open(r.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	rules, err := parseHosts(f)
+	if err != nil {
+		return fmt.Errorf("hosts file %s: %w", r.path, err)
+	}
+	r.mux.Lock()
+	r.file = rules
+	r.mux.Unlock()
+	return nil
+}
+
+func (r *HostsResolver) match(host string) ([]netip.Addr, bool) {
+	host = normalizeHost(host)
+	if addrs, ok := r.overrides.lookup(host); ok {
+		return addrs, true
+	}
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	return r.file.lookup(host)
+}
+
+func (r *HostsResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	addrs, _, err := r.LookupNetIPTTL(ctx, network, host)
+	return addrs, err
+}
+
+// LookupNetIPTTL resolves host. Static rules have no TTL.
+func (r *HostsResolver) LookupNetIPTTL(ctx context.Context, network, host string) ([]netip.Addr, time.Duration, error) {
+	addrs, ok := r.match(host)
+	if !ok {
+		return lookupTTL(ctx, r.next, network, host)
+	}
+	res := make([]netip.Addr, 0, len(addrs))
+	for _, addr := range addrs {
+		addr = addr.Unmap()
+		switch {
+		case network == "ip4" && !addr.Is4():
+		case network == "ip6" && !addr.Is6():
+		default:
+			res = append(res, addr)
+		}
+	}
+	if len(res) == 0 {
+		return nil, 0, &net.DNSError{Err: "no suitable address found", Name: host, IsNotFound: true}
+	}
+	return res, 0, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHostsResolver(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	err := os.WriteFile(path, []byte(
+		"# comment\n"+
+			"192.0.2.1 example.test alias.test # trailing comment\n"+
+			"2001:db8::1 example.test\n"+
+			"192.0.2.2 *.wild.test\n"+
+			"192.0.2.3 *.deep.wild.test\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := &countingResolver{
+		records: map[string][]netip.Addr{"other.test": {netip.MustParseAddr("192.0.2.100")}},
+	}
+	r, err := NewHostsResolver(next, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, addr, err := ParseHostOverride("alias.test=192.0.2.50")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.AddOverride(name, addr)
+
+	for _, c := range []struct {
+		network, host, want string
+	}{
+		{"ip", "example.test", "[192.0.2.1 2001:db8::1]"},
+		{"ip4", "Example.Test.", "[192.0.2.1]"},
+		{"ip6", "example.test", "[2001:db8::1]"},
+		{"ip", "alias.test", "[192.0.2.50]"},
+		{"ip", "a.wild.test", "[192.0.2.2]"},
+		{"ip", "a.b.wild.test", "[192.0.2.2]"},
+		{"ip", "a.deep.wild.test", "[192.0.2.3]"},
+		{"ip", "other.test", "[192.0.2.100]"},
+	} {
+		addrs, err := r.LookupNetIP(context.Background(), c.network, c.host)
+		if err != nil {
+			t.Errorf("%s %s: %v", c.network, c.host, err)
+			continue
+		}
+		if got := fmt.Sprint(addrs); got != c.want {
+			t.Errorf("%s %s: got %s, want %s", c.network, c.host, got, c.want)
+		}
+	}
+	if _, err := r.LookupNetIP(context.Background(), "ip", "wild.test"); err == nil {
+		t.Error("wildcard matches apex domain")
+	}
+	var dnsErr *net.DNSError
+	if _, err := r.LookupNetIP(context.Background(), "ip6", "alias.test"); !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Errorf("got error %v, want not found", err)
+	}
+
+	if err := os.WriteFile(path, []byte("192.0.2.9 example.test\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if addrs, _ := r.LookupNetIP(context.Background(), "ip", "example.test"); fmt.Sprint(addrs) != "[192.0.2.9]" {
+		t.Errorf("hosts file is not reloaded: %v", addrs)
+	}
+	if err := os.WriteFile(path, []byte("bogus example.test\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reload(); err == nil {
+		t.Error("malformed hosts file accepted")
+	}
+	if addrs, _ := r.LookupNetIP(context.Background(), "ip", "example.test"); fmt.Sprint(addrs) != "[192.0.2.9]" {
+		t.Errorf("rules are lost after failed reload: %v", addrs)
+	}
+}
+
+func TestParseHostOverride(t *testing.T) {
+	for _, spec := range []string{"example.test", "=192.0.2.1", "example.test=bogus"} {
+		if _, _, err := ParseHostOverride(spec); err == nil {
+			t.Errorf("spec %q accepted", spec)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	POLICY_ROUND_ROBIN = "round-robin"
+	POLICY_CLIENT      = "client"
+	POLICY_USER        = "user"
+	POLICY_DESTINATION = "destination"
+)
+
+// IdentityPolicy picks one of alive identities for a new proxy request.
+// alive is never empty.
+type IdentityPolicy func(req *http.Request, alive []*Identity) *Identity
+
+// IdentityPolicyFromString constructs policy by name. Sticky policies with
+// positive stickyTTL keep session on the same identity until it is idle for
+// stickyTTL. Otherwise requests are hashed onto identities.
+func IdentityPolicyFromString(name string, stickyTTL time.Duration) (IdentityPolicy, error) {
+	if stickyTTL < 0 {
+		return nil, errors.New("sticky session TTL can't be negative")
+	}
+	var key func(*http.Request) string
+	switch strings.ToLower(name) {
+	case POLICY_ROUND_ROBIN, "rr":
+		if stickyTTL > 0 {
+			return nil, errors.New("sticky session TTL is not applicable to " + POLICY_ROUND_ROBIN + " policy")
+		}
+		return RoundRobinPolicy(), nil
+	case POLICY_CLIENT:
+		key = requestClient
+	case POLICY_USER:
+		key = requestUsername
+	case POLICY_DESTINATION:
+		key = requestDestination
+	default:
+		return nil, fmt.Errorf("unknown identity distribution policy %q", name)
+	}
+	if stickyTTL > 0 {
+		return StickyPolicy(key, stickyTTL, RoundRobinPolicy()), nil
+	}
+	return HashPolicy(key), nil
+}
+
+func RoundRobinPolicy() IdentityPolicy {
+	var counter atomic.Uint64
+	return func(_ *http.Request, alive []*Identity) *Identity {
+		return alive[(counter.Add(1)-1)%uint64(len(alive))]
+	}
+}
+
+// HashPolicy consistently maps requests with the same key to the same
+// identity as long as set of alive identities stays the same.
+func HashPolicy(key func(*http.Request) string) IdentityPolicy {
+	return func(req *http.Request, alive []*Identity) *Identity {
+		h := fnv.New64a()
+		h.Write([]byte(key(req)))
+		return alive[h.Sum64()%uint64(len(alive))]
+	}
+}
+
+type stickySession struct {
+	ident   *Identity
+	expires time.Time
+}
+
+// StickyPolicy remembers identity picked by next for each session key and
+// reuses it while it stays alive and session is used at least once per ttl.
+func StickyPolicy(key func(*http.Request) string, ttl time.Duration, next IdentityPolicy) IdentityPolicy {
+	var (
+		mux       sync.Mutex
+		sessions  = make(map[string]stickySession)
+		lastSweep = time.Now()
+	)
+	return func(req *http.Request, alive []*Identity) *Identity {
+		k := key(req)
+		now := time.Now()
+		mux.Lock()
+		defer mux.Unlock()
+
+		if now.Sub(lastSweep) > ttl {
+			for sk, sess := range sessions {
+				if now.After(sess.expires) {
+					delete(sessions, sk)
+				}
+			}
+			lastSweep = now
+		}
+
+		if sess, ok := sessions[k]; ok && now.Before(sess.expires) {
+			for _, ident := range alive {
+				if ident == sess.ident {
+					sessions[k] = stickySession{ident, now.Add(ttl)}
+					return ident
+				}
+			}
+		}
+		ident := next(req, alive)
+		sessions[k] = stickySession{ident, now.Add(ttl)}
+		return ident
+	}
+}
+
+func requestClient(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+func requestDestination(req *http.Request) string {
+	hostport := req.Host
+	if strings.ToUpper(req.Method) == "CONNECT" {
+		hostport = req.RequestURI
+	} else if req.URL != nil && req.URL.Host != "" {
+		hostport = req.URL.Host
+	}
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return strings.ToLower(hostport)
+	}
+	return strings.ToLower(host)
+}
+
+// requestUsername returns username from client's Proxy-Authorization header
+// falling back to client address if there is none.
+func requestUsername(req *http.Request) string {
+	auth := req.Header.Get("Proxy-Authorization")
+	scheme, cred, ok := strings.Cut(auth, " ")
+	if !ok || !strings.EqualFold(scheme, "basic") {
+		return requestClient(req)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(cred))
+	if err != nil {
+		return requestClient(req)
+	}
+	username, _, _ := strings.Cut(string(decoded), ":")
+	return "user:" + username
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func testIdentities(n int) []*Identity {
+	res := make([]*Identity, n)
+	for i := range res {
+		res[i] = &Identity{id: i}
+	}
+	return res
+}
+
+func clientRequest(remoteAddr string) *http.Request {
+	req := httptest.NewRequest("CONNECT", "example.com:443", nil)
+	req.RemoteAddr = remoteAddr
+	return req
+}
+
+func TestIdentityPolicyFromString(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		ttl   time.Duration
+		valid bool
+	}{
+		{POLICY_ROUND_ROBIN, 0, true},
+		{POLICY_ROUND_ROBIN, time.Minute, false},
+		{POLICY_CLIENT, 0, true},
+		{POLICY_CLIENT, time.Minute, true},
+		{POLICY_DESTINATION, -time.Minute, false},
+		{"bogus", 0, false},
+	} {
+		_, err := IdentityPolicyFromString(tc.name, tc.ttl)
+		if (err == nil) != tc.valid {
+			t.Errorf("%s with TTL %v: got error %v, want valid = %v", tc.name, tc.ttl, err, tc.valid)
+		}
+	}
+}
+
+func TestHashPolicy(t *testing.T) {
+	alive := testIdentities(4)
+	policy := HashPolicy(requestClient)
+	seen := make(map[*Identity]bool)
+	for _, addr := range []string{"192.0.2.1:1000", "192.0.2.2:1000", "192.0.2.3:1000", "192.0.2.4:1000", "192.0.2.5:1000"} {
+		ident := policy(clientRequest(addr), alive)
+		seen[ident] = true
+		for i := 0; i < 3; i++ {
+			// Client port doesn't matter
+			if got := policy(clientRequest(addr[:len(addr)-4]+"2000"), alive); got != ident {
+				t.Errorf("%s mapped to identity #%d, then to #%d", addr, ident.ID(), got.ID())
+			}
+		}
+	}
+	if len(seen) < 2 {
+		t.Errorf("all clients mapped to the same identity")
+	}
+}
+
+func TestStickyPolicy(t *testing.T) {
+	alive := testIdentities(3)
+	const ttl = 50 * time.Millisecond
+	policy := StickyPolicy(requestClient, ttl, RoundRobinPolicy())
+
+	first := policy(clientRequest("192.0.2.1:1000"), alive)
+	other := policy(clientRequest("192.0.2.2:1000"), alive)
+	if first == other {
+		t.Fatal("new sessions should be distributed by underlying policy")
+	}
+	for i := 0; i < 3; i++ {
+		time.Sleep(ttl / 2)
+		// Use refreshes session
+		if got := policy(clientRequest("192.0.2.1:1001"), alive); got != first {
+			t.Fatalf("session moved from identity #%d to #%d", first.ID(), got.ID())
+		}
+	}
+
+	// Session follows to another identity when its identity is gone
+	if got := policy(clientRequest("192.0.2.1:1000"), []*Identity{alive[2]}); got != alive[2] {
+		t.Errorf("got identity #%d, want #2", got.ID())
+	}
+
+	// Idle session expires
+	second := policy(clientRequest("192.0.2.3:1000"), alive)
+	time.Sleep(2 * ttl)
+	third := policy(clientRequest("192.0.2.3:1000"), alive)
+	if second == third {
+		t.Errorf("expired session kept identity #%d", second.ID())
+	}
+}
+
+func TestRequestKeys(t *testing.T) {
+	req := clientRequest("192.0.2.1:1000")
+	if got := requestUsername(req); got != "192.0.2.1" {
+		t.Errorf("username without credentials = %q, want client address", got)
+	}
+	req.SetBasicAuth("alice", "secret")
+	req.Header.Set("Proxy-Authorization", req.Header.Get("Authorization"))
+	if got := requestUsername(req); got != "user:alice" {
+		t.Errorf("username = %q, want %q", got, "user:alice")
+	}
+	req.Header.Set("Proxy-Authorization", "Basic !!!")
+	if got := requestUsername(req); got != "192.0.2.1" {
+		t.Errorf("username with malformed credentials = %q, want client address", got)
+	}
+
+	if got := requestDestination(clientRequest("192.0.2.1:1000")); got != "example.com" {
+		t.Errorf("CONNECT destination = %q, want %q", got, "example.com")
+	}
+	plain := httptest.NewRequest("GET", "http://Example.ORG/path", nil)
+	if got := requestDestination(plain); got != "example.org" {
+		t.Errorf("plain request destination = %q, want %q", got, "example.org")
+	}
+}
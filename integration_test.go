@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testEnv struct {
+	pki   *testPKI
+	agent *fakeAgent
+	api   *fakeHolaAPI
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	pki := newTestPKI(t)
+	agent := newFakeAgent(t, pki)
+	api := newFakeHolaAPI(t, pki, agent.Listener.Addr().String())
+	setupHolaGlobals(t, pki, api.URL, nil)
+	return &testEnv{
+		pki:   pki,
+		agent: agent,
+		api:   api,
+	}
+}
+
+func (e *testEnv) upstreamFactory(name string, tunnels *ZGetTunnelsResponse, auth AuthProvider) (*Upstream, error) {
+	endpoint, err := get_endpoint(tunnels, "direct", false, "")
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{}
+	return &Upstream{
+		Name:          name,
+		Endpoint:      endpoint,
+		Dialer:        NewProxyDialer(endpoint.NetAddr(), endpoint.TLSName, e.pki.pool, auth, true, 0, dialer),
+		RequestDialer: NewPlaintextDialer(endpoint.NetAddr(), endpoint.TLSName, e.pki.pool, true, dialer),
+		Auth:          auth,
+	}, nil
+}
+
+// fallbackAgents returns fallback agents with given names served by test agent
+func (e *testEnv) fallbackAgents(names ...string) []FallbackAgent {
+	host, port, _ := net.SplitHostPort(e.agent.Listener.Addr().String())
+	portNum, _ := net.LookupPort("tcp", port)
+	res := make([]FallbackAgent, 0, len(names))
+	for _, name := range names {
+		res = append(res, FallbackAgent{
+			Name: name,
+			IP:   host,
+			Port: uint16(portNum),
+		})
+	}
+	return res
+}
+
+func (e *testEnv) credService(t *testing.T, poolSize int) (*IdentityPool, *BanMonitor, error) {
+	bans := NewBanMonitor(time.Millisecond, time.Millisecond, testLogger(t, "BAN     : "), nil)
+	pool, err := CredService(poolSize, RoundRobinPolicy(), bans, 0, 5*time.Second, "1.0", "us", "direct",
+		testLogger(t, "CRED    : "), time.Millisecond, 50*time.Millisecond, e.upstreamFactory)
+	if err == nil {
+		t.Cleanup(pool.Close)
+	}
+	return pool, bans, err
+}
+
+func (e *testEnv) startProxy(t *testing.T, upstreams UpstreamSelector, resolver LookupNetIPer) string {
+	if resolver == nil {
+		resolver = &net.Resolver{}
+	}
+	srv := httptest.NewServer(NewProxyHandler(upstreams, resolver, nil, FAMILY_ANY, TunnelLimits{}, testLogger(t, "PROXY   : ")))
+	t.Cleanup(srv.Close)
+	return srv.Listener.Addr().String()
+}
+
+func TestCredServiceBootstrap(t *testing.T) {
+	env := newTestEnv(t)
+	pool, _, err := env.credService(t, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := env.api.bgInitCalls.Load(); got != 2 {
+		t.Errorf("background_init was called %d times, want 2", got)
+	}
+	if alive := pool.Alive(); len(alive) != 2 {
+		t.Fatalf("got %d alive identities, want 2", len(alive))
+	}
+	seen := make(map[string]bool)
+	for i := 0; i < 4; i++ {
+		up, err := pool.SelectUpstream(httptest.NewRequest("CONNECT", "example.com:443", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if up.Endpoint.TLSName != "zagent1.hola.org" || up.Endpoint.Port != env.api.agentPort {
+			t.Errorf("unexpected endpoint %s", up.Endpoint.URL())
+		}
+		seen[up.Name] = true
+	}
+	if len(seen) != 2 {
+		t.Errorf("round robin policy used %d identities, want 2", len(seen))
+	}
+}
+
+func TestCredServiceBan(t *testing.T) {
+	env := newTestEnv(t)
+	env.api.bgInitBlocked.Store(true)
+	FALLBACK_CONF_URLS = []string{newFakeFallbackConfServer(t, env.pki, env.fallbackAgents("zagent2")).URL}
+	_, bans, err := env.credService(t, 1)
+	if !errors.Is(err, TemporaryBanError) {
+		t.Fatalf("got error %v, want %v", err, TemporaryBanError)
+	}
+	// Ban aborts transaction instead of retrying through fallback agents
+	if got := env.api.bgInitCalls.Load(); got != 1 {
+		t.Errorf("background_init was called %d times, want 1", got)
+	}
+	st := bans.Stats()
+	if st.Temporary != 1 || st.LastBanKind != BAN_KIND_TEMPORARY {
+		t.Errorf("unexpected ban stats: %+v", st)
+	}
+}
+
+func TestCredServicePermanentBanDropsAgent(t *testing.T) {
+	env := newTestEnv(t)
+	apiAddr := env.api.Listener.Addr().String()
+	setupHolaGlobals(t, env.pki, env.api.URL, dialerFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+		if address == apiAddr {
+			return nil, errors.New("connection refused by test")
+		}
+		return (&net.Dialer{}).DialContext(ctx, network, address)
+	}))
+	env.api.bgInitBlocked.Store(true)
+	env.api.bgInitPermanent.Store(true)
+	FALLBACK_CONF_URLS = []string{newFakeFallbackConfServer(t, env.pki, env.fallbackAgents("zagent2", "zagent3")).URL}
+	_, _, err := env.credService(t, 1)
+	if !errors.Is(err, PermanentBanError) {
+		t.Fatalf("got error %v, want %v", err, PermanentBanError)
+	}
+	if got := env.api.bgInitCalls.Load(); got != 1 {
+		t.Errorf("background_init was called %d times, want 1", got)
+	}
+	fbc, err := GetFallbackProxies(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fbc.Agents) != 1 {
+		t.Errorf("got fallback agents %v, want banned one dropped", fbc.Agents)
+	}
+}
+
+func TestEnsureTransactionFallback(t *testing.T) {
+	env := newTestEnv(t)
+	apiAddr := env.api.Listener.Addr().String()
+	// Direct connections to API fail, so fallback agent is the only way.
+	setupHolaGlobals(t, env.pki, env.api.URL, dialerFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+		if address == apiAddr {
+			return nil, errors.New("connection refused by test")
+		}
+		return (&net.Dialer{}).DialContext(ctx, network, address)
+	}))
+	host, port, _ := net.SplitHostPort(env.agent.Listener.Addr().String())
+	portNum, _ := net.LookupPort("tcp", port)
+	conf := newFakeFallbackConfServer(t, env.pki, []FallbackAgent{{
+		Name: "zagent2",
+		IP:   host,
+		Port: uint16(portNum),
+	}})
+	FALLBACK_CONF_URLS = []string{conf.URL + "/cloud_failover.conf"}
+
+	attempts := 0
+	var countries CountryList
+	ok, err := EnsureTransaction(context.Background(), 5*time.Second, func(ctx context.Context, client *http.Client) bool {
+		attempts++
+		var err error
+		countries, err = VPNCountries(ctx, client)
+		return err == nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("transaction failed")
+	}
+	if attempts != 2 {
+		t.Errorf("got %d attempts, want 2", attempts)
+	}
+	if env.agent.connects.Load() == 0 {
+		t.Error("fallback agent was not used")
+	}
+	if len(countries) != 4 {
+		t.Errorf("unexpected country list: %v", countries)
+	}
+}
+
+func TestProxyHandlerTunnel(t *testing.T) {
+	env := newTestEnv(t)
+	pool, _, err := env.credService(t, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyAddr := env.startProxy(t, pool, nil)
+	conn := connectVia(t, proxyAddr, startEchoServer(t))
+	defer conn.Close()
+	assertEcho(t, conn, []byte("hello through hola"))
+}
+
+func TestProxyHandlerRequest(t *testing.T) {
+	env := newTestEnv(t)
+	pool, _, err := env.credService(t, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Proxy-Authorization") != "" {
+			t.Error("Proxy-Authorization leaked to destination")
+		}
+		fmt.Fprint(wr, "plain response")
+	}))
+	defer target.Close()
+	proxyAddr := env.startProxy(t, pool, nil)
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: proxyAddr}),
+		},
+	}
+	resp, err := client.Get(target.URL + "/path")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "plain response" {
+		t.Fatalf("unexpected response: %s %q", resp.Status, body)
+	}
+	if env.agent.requests.Load() != 1 {
+		t.Errorf("agent served %d requests, want 1", env.agent.requests.Load())
+	}
+}
+
+func TestProxyHandlerRetiresRejectedIdentity(t *testing.T) {
+	env := newTestEnv(t)
+	pool, _, err := env.credService(t, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	up, err := pool.SelectUpstream(httptest.NewRequest("CONNECT", "example.com:443", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.agent.rejectAuth.Store(true)
+	_, err = up.Dialer.DialContext(context.Background(), "tcp", startEchoServer(t))
+	if !errors.Is(err, UpstreamAuthError) {
+		t.Fatalf("got error %v, want %v", err, UpstreamAuthError)
+	}
+	if alive := pool.Alive(); len(alive) != 0 {
+		t.Errorf("rejected identity is still alive")
+	}
+}
+
+func TestRetryDialerBlockedHost(t *testing.T) {
+	env := newTestEnv(t)
+	env.agent.Block("blocked.test")
+	doh := newFakeDoH(t, env.pki, map[string][]netip.Addr{
+		"blocked.test": {netip.MustParseAddr("127.0.0.1")},
+	})
+	pool, _, err := env.credService(t, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyAddr := env.startProxy(t, pool, doh.Resolver(t, env.pki))
+	rec := recordEvents(t)
+
+	_, port, _ := net.SplitHostPort(startEchoServer(t))
+	conn := connectVia(t, proxyAddr, net.JoinHostPort("blocked.test", port))
+	defer conn.Close()
+	assertEcho(t, conn, []byte("rescued"))
+	if doh.queries.Load() == 0 {
+		t.Error("fallback resolver was not used")
+	}
+	if ev := rec.Next(t, EVENT_AGENT_CHANGED); ev.Data["identity"] != "0" || ev.Data["endpoint"] == "" {
+		t.Errorf("unexpected agent change event: %+v", ev)
+	}
+	if ev := rec.Next(t, EVENT_HOST_BLOCKED); ev.Data["host"] != "blocked.test" || ev.Data["port"] != port {
+		t.Errorf("unexpected blocked host event: %+v", ev)
+	}
+	if ev := rec.Next(t, EVENT_RESOLVE_FALLBACK); ev.Data["reason"] != "blocked" {
+		t.Errorf("unexpected fallback event: %+v", ev)
+	}
+}
+
+type dialerFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+func (f dialerFunc) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return f(ctx, network, address)
+}
+
+func (f dialerFunc) Dial(network, address string) (net.Conn, error) {
+	return f(context.Background(), network, address)
+}
+
+func TestProxyHandlerRequestBlockedHost(t *testing.T) {
+	env := newTestEnv(t)
+	env.agent.Block("blocked.test")
+	doh := newFakeDoH(t, env.pki, map[string][]netip.Addr{
+		"blocked.test": {netip.MustParseAddr("127.0.0.1")},
+	})
+	target := httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		wr.Write(body)
+	}))
+	defer target.Close()
+	pool, _, err := env.credService(t, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyAddr := env.startProxy(t, pool, doh.Resolver(t, env.pki))
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: proxyAddr}),
+		},
+	}
+	_, port, _ := net.SplitHostPort(target.Listener.Addr().String())
+	host := net.JoinHostPort("blocked.test", port)
+	resp, err := client.Post("http://"+host+"/form", "text/plain", strings.NewReader("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "payload" {
+		t.Fatalf("unexpected response: %s %q", resp.Status, body)
+	}
+	if doh.queries.Load() == 0 {
+		t.Error("fallback resolver was not used")
+	}
+	if env.agent.requests.Load() != 2 {
+		t.Errorf("agent served %d requests, want 2", env.agent.requests.Load())
+	}
+}
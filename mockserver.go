@@ -0,0 +1,518 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	stdtls "crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	MOCK_AGENT_KEY   = "mockagentkey"
+	MOCK_SESSION_KEY = 1234567890
+)
+
+// MockDuration is a time.Duration represented as a string in JSON
+type MockDuration time.Duration
+
+func (d *MockDuration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	dur, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = MockDuration(dur)
+	return nil
+}
+
+// MockStep describes behavior of mock endpoint for Count consecutive
+// requests. Zero Count means the step lasts forever.
+type MockStep struct {
+	Count int          `json:"count"`
+	Delay MockDuration `json:"delay"`
+	// Status overrides normal response with given HTTP status code
+	Status int `json:"status"`
+	// Ban is either "temporary" or "permanent". background_init only.
+	Ban string `json:"ban"`
+	// EmptyIPList makes zgettunnels return no tunnels
+	EmptyIPList bool `json:"empty_ip_list"`
+	// ForbiddenHost makes agent reject request as blocked by Hola
+	ForbiddenHost bool `json:"forbidden_host"`
+}
+
+type mockScript struct {
+	mux   sync.Mutex
+	steps []MockStep
+	used  int
+}
+
+// next returns behavior for the next request. Default behavior is returned
+// once script is over.
+func (s *mockScript) next() MockStep {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if len(s.steps) == 0 {
+		return MockStep{}
+	}
+	step := s.steps[0]
+	s.used++
+	if step.Count > 0 && s.used >= step.Count {
+		s.steps = s.steps[1:]
+		s.used = 0
+	}
+	return step
+}
+
+type MockScenario struct {
+	Countries      []string   `json:"countries"`
+	AgentKey       string     `json:"agent_key"`
+	Agents         []string   `json:"agents"`
+	BlockedHosts   []string   `json:"blocked_hosts"`
+	VPNCountries   []MockStep `json:"vpn_countries"`
+	BackgroundInit []MockStep `json:"background_init"`
+	ZGetTunnels    []MockStep `json:"zgettunnels"`
+	FallbackConf   []MockStep `json:"fallback_conf"`
+	Agent          []MockStep `json:"agent"`
+}
+
+func LoadMockScenario(filename string) (*MockScenario, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	sc := &MockScenario{}
+	if err := json.Unmarshal(data, sc); err != nil {
+		return nil, fmt.Errorf("unable to parse scenario: %w", err)
+	}
+	return sc, nil
+}
+
+// MockServer imitates Hola control plane and Hola agent
+type MockServer struct {
+	scenario       *MockScenario
+	logger         *CondLogger
+	agentHost      string
+	agentPort      uint16
+	blocked        map[string]bool
+	vpnCountries   *mockScript
+	backgroundInit *mockScript
+	zgettunnels    *mockScript
+	fallbackConf   *mockScript
+	agent          *mockScript
+}
+
+// NewMockServer creates mock server. agentAddr is the address of agent
+// announced in API responses.
+func NewMockServer(scenario *MockScenario, agentAddr string, logger *CondLogger) (*MockServer, error) {
+	host, portStr, err := net.SplitHostPort(agentAddr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	if host == "" || net.ParseIP(host).IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	if scenario.AgentKey == "" {
+		scenario.AgentKey = MOCK_AGENT_KEY
+	}
+	if len(scenario.Agents) == 0 {
+		scenario.Agents = []string{"zagent-mock"}
+	}
+	if scenario.Countries == nil {
+		scenario.Countries = []string{"us", "de", "gb"}
+	}
+	blocked := make(map[string]bool)
+	for _, h := range scenario.BlockedHosts {
+		blocked[strings.ToLower(h)] = true
+	}
+	return &MockServer{
+		scenario:       scenario,
+		logger:         logger,
+		agentHost:      host,
+		agentPort:      uint16(port),
+		blocked:        blocked,
+		vpnCountries:   &mockScript{steps: scenario.VPNCountries},
+		backgroundInit: &mockScript{steps: scenario.BackgroundInit},
+		zgettunnels:    &mockScript{steps: scenario.ZGetTunnels},
+		fallbackConf:   &mockScript{steps: scenario.FallbackConf},
+		agent:          &mockScript{steps: scenario.Agent},
+	}, nil
+}
+
+// APIHandler serves client_cgi methods and fallback config
+func (s *MockServer) APIHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/client_cgi/vpn_countries.json", s.handleVPNCountries)
+	mux.HandleFunc("/client_cgi/background_init", s.handleBackgroundInit)
+	mux.HandleFunc("/client_cgi/zgettunnels", s.handleZGetTunnels)
+	mux.HandleFunc("/cloud_failover.conf", s.handleFallbackConf)
+	return mux
+}
+
+// AgentHandler serves proxy requests
+func (s *MockServer) AgentHandler() http.Handler {
+	return http.HandlerFunc(s.handleAgent)
+}
+
+// apply performs common step actions. Returns true if request is handled.
+func (s *MockServer) apply(step MockStep, wr http.ResponseWriter, req *http.Request) bool {
+	if step.Delay > 0 {
+		select {
+		case <-time.After(time.Duration(step.Delay)):
+		case <-req.Context().Done():
+			return true
+		}
+	}
+	if step.Status != 0 {
+		s.logger.Info("%s %s: scripted status %d", req.Method, req.URL, step.Status)
+		http.Error(wr, http.StatusText(step.Status), step.Status)
+		return true
+	}
+	return false
+}
+
+func (s *MockServer) handleVPNCountries(wr http.ResponseWriter, req *http.Request) {
+	if s.apply(s.vpnCountries.next(), wr, req) {
+		return
+	}
+	wr.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(wr).Encode(CountryList(s.scenario.Countries))
+}
+
+func (s *MockServer) handleBackgroundInit(wr http.ResponseWriter, req *http.Request) {
+	step := s.backgroundInit.next()
+	if s.apply(step, wr, req) {
+		return
+	}
+	if req.URL.Query().Get("uuid") == "" {
+		http.Error(wr, "uuid is missing", http.StatusBadRequest)
+		return
+	}
+	resp := BgInitResponse{
+		Ver:     req.PostFormValue("ver"),
+		Key:     MOCK_SESSION_KEY,
+		Country: "us",
+	}
+	switch step.Ban {
+	case BAN_KIND_TEMPORARY:
+		resp.Blocked = true
+	case BAN_KIND_PERMANENT:
+		resp.Blocked = true
+		resp.Permanent = true
+	}
+	s.logger.Info("background_init for uuid %s: blocked=%t permanent=%t",
+		req.URL.Query().Get("uuid"), resp.Blocked, resp.Permanent)
+	wr.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(wr).Encode(resp)
+}
+
+func (s *MockServer) handleZGetTunnels(wr http.ResponseWriter, req *http.Request) {
+	step := s.zgettunnels.next()
+	if s.apply(step, wr, req) {
+		return
+	}
+	if req.URL.Query().Get("session_key") != strconv.Itoa(MOCK_SESSION_KEY) {
+		http.Error(wr, "bad session key", http.StatusForbidden)
+		return
+	}
+	resp := ZGetTunnelsResponse{
+		AgentKey:   s.scenario.AgentKey,
+		AgentTypes: make(map[string]string),
+		IPList:     make(map[string]string),
+		Port: PortMap{
+			Direct:    s.agentPort,
+			Hola:      s.agentPort,
+			Peer:      s.agentPort,
+			Trial:     s.agentPort,
+			TrialPeer: s.agentPort,
+		},
+		Protocol: make(map[string]string),
+		Vendor:   make(map[string]string),
+		Ztun:     make(map[string][]string),
+	}
+	if !step.EmptyIPList {
+		for _, name := range s.scenario.Agents {
+			host := name + AGENT_SUFFIX
+			resp.IPList[host] = s.agentHost
+			resp.AgentTypes[host] = "vps"
+			resp.Protocol[host] = "HTTP"
+			resp.Vendor[host] = "mock"
+		}
+	}
+	s.logger.Info("zgettunnels for uuid %s: %d tunnels", req.URL.Query().Get("uuid"), len(resp.IPList))
+	wr.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(wr).Encode(resp)
+}
+
+func (s *MockServer) handleFallbackConf(wr http.ResponseWriter, req *http.Request) {
+	if s.apply(s.fallbackConf.next(), wr, req) {
+		return
+	}
+	conf := fallbackConfResponse{
+		UpdatedAt: time.Now().UnixMilli(),
+		TTL:       time.Hour.Milliseconds(),
+	}
+	for _, name := range s.scenario.Agents {
+		conf.Agents = append(conf.Agents, FallbackAgent{
+			Name: name,
+			IP:   s.agentHost,
+			Port: s.agentPort,
+		})
+	}
+	data, err := json.Marshal(conf)
+	if err != nil {
+		http.Error(wr, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Client moves three trailing characters to the beginning before decoding
+	enc := base64.RawStdEncoding.EncodeToString(data)
+	io.WriteString(wr, enc[3:]+enc[:3])
+}
+
+func (s *MockServer) agentAuthorized(req *http.Request) bool {
+	hdr := req.Header.Get(PROXY_AUTHORIZATION_HEADER)
+	if hdr == "" {
+		// fallback agents are used without credentials
+		return true
+	}
+	scheme, cred, _ := strings.Cut(hdr, " ")
+	if !strings.EqualFold(scheme, "basic") {
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(cred)
+	if err != nil {
+		return false
+	}
+	_, password, _ := strings.Cut(string(decoded), ":")
+	return password == s.scenario.AgentKey
+}
+
+func (s *MockServer) handleAgent(wr http.ResponseWriter, req *http.Request) {
+	step := s.agent.next()
+	if s.apply(step, wr, req) {
+		return
+	}
+	if !s.agentAuthorized(req) {
+		s.logger.Info("%s %s: bad credentials", req.Method, req.RequestURI)
+		http.Error(wr, "Proxy Authentication Required", http.StatusProxyAuthRequired)
+		return
+	}
+
+	host := req.URL.Hostname()
+	if req.Method == http.MethodConnect {
+		host, _, _ = net.SplitHostPort(req.RequestURI)
+	}
+	if step.ForbiddenHost || s.blocked[strings.ToLower(host)] {
+		s.logger.Info("%s %s: forbidden host", req.Method, req.RequestURI)
+		wr.Header().Set("X-Hola-Error", "Forbidden Host")
+		wr.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if req.Method == http.MethodConnect {
+		s.agentTunnel(wr, req)
+		return
+	}
+
+	outreq := req.Clone(req.Context())
+	outreq.RequestURI = ""
+	outreq.Header.Del(PROXY_AUTHORIZATION_HEADER)
+	resp, err := http.DefaultTransport.RoundTrip(outreq)
+	if err != nil {
+		http.Error(wr, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	s.logger.Info("%s %s: %s", req.Method, req.URL, resp.Status)
+	copyHeader(wr.Header(), resp.Header)
+	wr.WriteHeader(resp.StatusCode)
+	copyBody(wr, resp.Body)
+}
+
+func (s *MockServer) agentTunnel(wr http.ResponseWriter, req *http.Request) {
+	target, err := (&net.Dialer{}).DialContext(req.Context(), "tcp", req.RequestURI)
+	if err != nil {
+		s.logger.Info("CONNECT %s: %v", req.RequestURI, err)
+		http.Error(wr, err.Error(), http.StatusBadGateway)
+		return
+	}
+	conn, rw, err := hijack(wr)
+	if err != nil {
+		target.Close()
+		return
+	}
+	s.logger.Info("CONNECT %s: established", req.RequestURI)
+	io.WriteString(conn, "HTTP/1.1 200 OK\r\n\r\n")
+	go func() {
+		io.Copy(target, rw)
+		target.Close()
+	}()
+	io.Copy(conn, target)
+	conn.Close()
+}
+
+// GenerateMockPKI issues self-signed CA and a server certificate signed by
+// it, valid for given hostnames and IP addresses.
+func GenerateMockPKI(names []string, validity time.Duration) (caPEM []byte, cert stdtls.Certificate, err error) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return
+	}
+	notBefore := time.Now().Add(-time.Hour)
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "hola-proxy mock CA"},
+		NotBefore:             notBefore,
+		NotAfter:              notBefore.Add(validity),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		return
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		return
+	}
+
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return
+	}
+	leafTmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "hola-proxy mock server"},
+		NotBefore:    notBefore,
+		NotAfter:     notBefore.Add(validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			leafTmpl.IPAddresses = append(leafTmpl.IPAddresses, ip)
+		} else {
+			leafTmpl.DNSNames = append(leafTmpl.DNSNames, name)
+		}
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leafTmpl, caCert, &leafKey.PublicKey, caKey)
+	if err != nil {
+		return
+	}
+
+	caPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})
+	cert = stdtls.Certificate{
+		Certificate: [][]byte{leafDER},
+		PrivateKey:  leafKey,
+	}
+	return
+}
+
+func runMockServer(argv []string) int {
+	fs := flag.NewFlagSet("mock-server", flag.ExitOnError)
+	apiBindAddress := fs.String("api-bind-address", "127.0.0.1:8443", "mock Hola API listen address")
+	agentBindAddress := fs.String("agent-bind-address", "127.0.0.1:22225", "mock Hola agent listen address")
+	scenarioFile := fs.String("scenario", "", "JSON file with scripted behavior of mock server")
+	caOut := fs.String("ca-out", "mock-ca.pem", "file to write mock CA certificate to. Pass it to -cafile option of client")
+	verbosity := fs.Int("verbosity", 20, "logging verbosity "+
+		"(10 - debug, 20 - info, 30 - warning, 40 - error, 50 - critical)")
+	fs.Parse(argv)
+
+	logWriter := NewLogWriter(os.Stderr)
+	defer logWriter.Close()
+	logger := NewCondLogger(log.New(logWriter, "MOCK    : ",
+		log.LstdFlags|log.Lshortfile),
+		*verbosity)
+
+	scenario := &MockScenario{}
+	if *scenarioFile != "" {
+		var err error
+		scenario, err = LoadMockScenario(*scenarioFile)
+		if err != nil {
+			logger.Critical("Can't load scenario: %v", err)
+			return 2
+		}
+	}
+
+	names := []string{"localhost", "127.0.0.1", "::1", "*" + AGENT_SUFFIX, "client.hola.org"}
+	for _, addr := range []string{*apiBindAddress, *agentBindAddress} {
+		if host, _, err := net.SplitHostPort(addr); err == nil && host != "" {
+			names = append(names, host)
+		}
+	}
+	caPEM, cert, err := GenerateMockPKI(names, 24*time.Hour)
+	if err != nil {
+		logger.Critical("Can't generate certificates: %v", err)
+		return 15
+	}
+	if err := ioutil.WriteFile(*caOut, caPEM, 0644); err != nil {
+		logger.Critical("Can't write CA certificate: %v", err)
+		return 15
+	}
+	tlsCfg := &stdtls.Config{
+		Certificates: []stdtls.Certificate{cert},
+		NextProtos:   []string{"http/1.1"},
+	}
+
+	agentListener, err := stdtls.Listen("tcp", *agentBindAddress, tlsCfg)
+	if err != nil {
+		logger.Critical("Can't listen agent address: %v", err)
+		return 3
+	}
+	apiListener, err := stdtls.Listen("tcp", *apiBindAddress, tlsCfg)
+	if err != nil {
+		logger.Critical("Can't listen API address: %v", err)
+		return 3
+	}
+	srv, err := NewMockServer(scenario, agentListener.Addr().String(), logger)
+	if err != nil {
+		logger.Critical("Can't create mock server: %v", err)
+		return 2
+	}
+
+	logger.Info("Mock CA certificate is written to %s", *caOut)
+	logger.Info("Serving mock API at https://%s/client_cgi/ and agent at %s",
+		apiListener.Addr(), agentListener.Addr())
+	logger.Info("Run client with: -api-url https://%s/client_cgi/ -fallback-conf-url https://%s/cloud_failover.conf "+
+		"-cafile %s -ext-ver 1.0.0 -user-agent mock", apiListener.Addr(), apiListener.Addr(), *caOut)
+
+	errCh := make(chan error, 2)
+	go func() {
+		errCh <- (&http.Server{Handler: srv.AgentHandler()}).Serve(agentListener)
+	}()
+	go func() {
+		errCh <- (&http.Server{Handler: srv.APIHandler()}).Serve(apiListener)
+	}()
+	err = <-errCh
+	if !errors.Is(err, http.ErrServerClosed) {
+		logger.Critical("Server terminated with a reason: %v", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestMockServerScenario(t *testing.T) {
+	pki := newTestPKI(t)
+	scenario := &MockScenario{
+		BackgroundInit: []MockStep{{Count: 1, Ban: BAN_KIND_TEMPORARY}},
+		ZGetTunnels:    []MockStep{{Count: 1, EmptyIPList: true}},
+		Agent:          []MockStep{{Count: 1, Status: http.StatusProxyAuthRequired}},
+	}
+	agentSrv := pki.startTLS(t, nil)
+	mock, err := NewMockServer(scenario, agentSrv.Listener.Addr().String(), testLogger(t, "MOCK    : "))
+	if err != nil {
+		t.Fatal(err)
+	}
+	agentSrv.Config.Handler = mock.AgentHandler()
+	apiSrv := pki.startTLS(t, mock.APIHandler())
+	setupHolaGlobals(t, pki, apiSrv.URL, nil)
+	FALLBACK_CONF_URLS = []string{apiSrv.URL + "/cloud_failover.conf"}
+
+	client := httpClientWithProxy(nil)
+	defer client.CloseIdleConnections()
+	logger := testLogger(t, "CRED    : ")
+	ctx := context.Background()
+
+	_, _, err = Tunnels(ctx, logger, client, "1.0", "us", "direct", 3, 5*time.Second, time.Millisecond, time.Second)
+	if !errors.Is(err, TemporaryBanError) {
+		t.Fatalf("got error %v, want %v", err, TemporaryBanError)
+	}
+	tunnels, userUUID, err := Tunnels(ctx, logger, client, "1.0", "us", "direct", 3, 5*time.Second, time.Millisecond, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoint, err := get_endpoint(tunnels, "direct", false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if endpoint.TLSName != "zagent-mock.hola.org" {
+		t.Errorf("unexpected agent %q", endpoint.TLSName)
+	}
+
+	fbc, err := GetFallbackProxies(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fbc.Agents) != 1 || fbc.Agents[0].Name != "zagent-mock" {
+		t.Errorf("unexpected fallback agents: %+v", fbc.Agents)
+	}
+
+	authHeader := basic_auth_header(TemplateLogin(userUUID), tunnels.AgentKey)
+	dialer := NewProxyDialer(endpoint.NetAddr(), endpoint.TLSName, pki.pool,
+		func() string { return authHeader }, true, 0, &net.Dialer{})
+	target := startEchoServer(t)
+	if _, err := dialer.DialContext(ctx, "tcp", target); !errors.Is(err, UpstreamAuthError) {
+		t.Fatalf("got error %v, want %v", err, UpstreamAuthError)
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	assertEcho(t, conn, []byte("mock"))
+}
@@ -51,16 +51,7 @@ func (d *PlaintextDialer) DialContext(ctx context.Context, network, address stri
 			ServerName:         sni,
 			InsecureSkipVerify: true,
 			VerifyConnection: func(cs tls.ConnectionState) error {
-				opts := x509.VerifyOptions{
-					DNSName:       d.tlsServerName,
-					Intermediates: x509.NewCertPool(),
-					Roots:         d.caPool,
-				}
-				for _, cert := range cs.PeerCertificates[1:] {
-					opts.Intermediates.AddCert(cert)
-				}
-				_, err := cs.PeerCertificates[0].Verify(opts)
-				return err
+				return verifyPeerCertificates(cs.PeerCertificates, d.tlsServerName, d.caPool)
 			},
 		}, tls.HelloAndroid_11_OkHttp)
 		if err := tlsConn.HandshakeContext(ctx); err != nil {
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	stdtls "crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// ALPN token of DNS over dedicated QUIC connections, RFC 9250
+const DOQ_ALPN = "doq"
+
+var QUICOverProxyError = errors.New("QUIC resolvers can't be used through base proxy")
+
+// doqExchanger sends each query over new stream of shared QUIC connection,
+// RFC 9250
+type doqExchanger struct {
+	addr      string
+	tlsConfig *stdtls.Config
+	mux       sync.Mutex
+	conn      *quic.Conn
+	dial      *doqDial
+}
+
+// doqDial is a handshake in progress shared by all callers waiting for
+// connection
+type doqDial struct {
+	done chan struct{}
+	conn *quic.Conn
+	err  error
+}
+
+// connection returns shared connection, establishing it if needed. Lock is
+// not held during handshake, so callers can give up on their own context.
+func (e *doqExchanger) connection(ctx context.Context) (*quic.Conn, error) {
+	e.mux.Lock()
+	if e.conn != nil && e.conn.Context().Err() == nil {
+		conn := e.conn
+		e.mux.Unlock()
+		return conn, nil
+	}
+	d := e.dial
+	if d == nil {
+		d = &doqDial{
+			done: make(chan struct{}),
+		}
+		e.dial = d
+		go e.handshake(d)
+	}
+	e.mux.Unlock()
+	select {
+	case <-d.done:
+		return d.conn, d.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// handshake establishes connection independently of any caller's context
+func (e *doqExchanger) handshake(d *doqDial) {
+	ctx, cl := context.WithTimeout(context.Background(), DNS_QUERY_TIMEOUT)
+	defer cl()
+	d.conn, d.err = quic.DialAddr(ctx, e.addr, e.tlsConfig, &quic.Config{
+		MaxIdleTimeout: 30 * time.Second,
+	})
+	e.mux.Lock()
+	e.dial = nil
+	if d.err == nil {
+		e.conn = d.conn
+	}
+	e.mux.Unlock()
+	close(d.done)
+}
+
+func (e *doqExchanger) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cl context.CancelFunc
+		ctx, cl = context.WithTimeout(ctx, DNS_QUERY_TIMEOUT)
+		defer cl()
+	}
+	conn, err := e.connection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		// Running out of time waiting for stream says nothing about shared
+		// connection, unless it is gone.
+		if (errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)) &&
+			conn.Context().Err() == nil {
+			return nil, err
+		}
+		// Connection may have been closed by server meanwhile
+		conn.CloseWithError(0, "")
+		if conn, err = e.connection(ctx); err != nil {
+			return nil, err
+		}
+		if stream, err = conn.OpenStreamSync(ctx); err != nil {
+			return nil, err
+		}
+	}
+	defer stream.CancelRead(0)
+	deadline, _ := ctx.Deadline()
+	stream.SetDeadline(deadline)
+
+	// Message ID has to be zero over DoQ
+	id := binary.BigEndian.Uint16(query)
+	framed := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(framed, uint16(len(query)))
+	copy(framed[2:], query)
+	binary.BigEndian.PutUint16(framed[2:], 0)
+	if _, err := stream.Write(framed); err != nil {
+		return nil, err
+	}
+	// Client signals end of query by closing its side of stream
+	stream.Close()
+
+	var size [2]byte
+	if _, err := io.ReadFull(stream, size[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(stream, resp); err != nil {
+		return nil, err
+	}
+	if len(resp) >= 2 {
+		binary.BigEndian.PutUint16(resp, id)
+	}
+	return resp, nil
+}
+
+// NewDoQResolver creates DNS-over-QUIC resolver for server at addr. QUIC
+// runs over UDP, so it can't be used through base proxy dialer. If
+// tlsConfig is nil, server certificate is verified against host part of
+// addr.
+func NewDoQResolver(addr string, dialer ContextDialer, tlsConfig *stdtls.Config) (*MessageResolver, error) {
+	if dialer != nil {
+		return nil, QUICOverProxyError
+	}
+	if tlsConfig == nil {
+		host, _, _ := net.SplitHostPort(addr)
+		tlsConfig = &stdtls.Config{
+			ServerName: host,
+		}
+	} else {
+		tlsConfig = tlsConfig.Clone()
+	}
+	tlsConfig.NextProtos = []string{DOQ_ALPN}
+	return NewMessageResolver(&doqExchanger{
+		addr:      addr,
+		tlsConfig: tlsConfig,
+	}), nil
+}
+
+// dohExchanger posts queries to DNS-over-HTTPS endpoint (RFC 8484)
+type dohExchanger struct {
+	uri    string
+	client *http.Client
+}
+
+func (e *dohExchanger) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.uri, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad status code from DoH server: %d", resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, MAX_DNS_MESSAGE))
+}
+
+// NewH3Resolver creates DNS-over-HTTP/3 resolver for endpoint at uri with
+// https scheme. tlsConfig may be nil.
+func NewH3Resolver(uri string, dialer ContextDialer, tlsConfig *stdtls.Config) (*MessageResolver, error) {
+	if dialer != nil {
+		return nil, QUICOverProxyError
+	}
+	return NewMessageResolver(&dohExchanger{
+		uri: uri,
+		client: &http.Client{
+			Transport: &http3.Transport{
+				TLSClientConfig: tlsConfig,
+			},
+		},
+	}), nil
+}
@@ -2,108 +2,356 @@ package main
 
 import (
 	"context"
+	stdtls "crypto/tls"
 	"errors"
 	"fmt"
+	"math/rand"
 	"net"
+	"net/http"
 	"net/netip"
 	"net/url"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/hashicorp/go-multierror"
-	"github.com/ncruces/go-dns"
+	"github.com/miekg/dns"
+	godns "github.com/ncruces/go-dns"
 )
 
-func FromURL(u string) (*net.Resolver, error) {
-begin:
-	parsed, err := url.Parse(u)
+var PlainDoHOverProxyError = errors.New("DoH resolvers without TLS can't be used through base proxy")
+
+// FromURL creates resolver for server specified by URL. Resolver connects
+// to server through base proxy dialer, or directly if dialer is nil.
+func FromURL(u string, dialer ContextDialer) (*MessageResolver, error) {
+	u, parsed, err := parseResolverURL(u)
 	if err != nil {
 		return nil, err
 	}
 	host := parsed.Hostname()
 	port := parsed.Port()
-	switch scheme := strings.ToLower(parsed.Scheme); scheme {
-	case "":
-		switch {
-		case strings.HasPrefix(u, "//"):
-			u = "dns:" + u
-		default:
-			u = "dns://" + u
-		}
-		goto begin
+	switch scheme := parsed.Scheme; scheme {
 	case "udp", "dns":
 		if port == "" {
 			port = "53"
 		}
-		return NewPlainResolver(net.JoinHostPort(host, port)), nil
+		return NewPlainResolver(net.JoinHostPort(host, port), dialer), nil
 	case "tcp":
 		if port == "" {
 			port = "53"
 		}
-		return NewTCPResolver(net.JoinHostPort(host, port)), nil
+		return NewTCPResolver(net.JoinHostPort(host, port), dialer), nil
 	case "http", "https", "doh":
-		if port == "" {
-			if scheme == "http" {
-				port = "80"
-			} else {
-				port = "443"
-			}
-		}
 		if scheme == "doh" {
 			parsed.Scheme = "https"
 			u = parsed.String()
 		}
-		return dns.NewDoHResolver(u, dns.DoHAddresses(net.JoinHostPort(host, port)))
+		return NewDoHResolver(u, dialer, nil)
 	case "tls", "dot":
 		if port == "" {
 			port = "853"
 		}
-		hp := net.JoinHostPort(host, port)
-		return dns.NewDoTResolver(hp, dns.DoTAddresses(hp))
+		return NewDoTResolver(net.JoinHostPort(host, port), dialer, nil)
+	case "quic", "doq":
+		if port == "" {
+			port = "853"
+		}
+		return NewDoQResolver(net.JoinHostPort(host, port), dialer, nil)
+	case "h3":
+		parsed.Scheme = "https"
+		return NewH3Resolver(parsed.String(), dialer, nil)
 	default:
 		return nil, errors.New("not implemented")
 	}
 }
 
+// parseResolverURL parses resolver URL. Address without scheme is taken as
+// plain DNS server.
+func parseResolverURL(u string) (string, *url.URL, error) {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return "", nil, err
+	}
+	if parsed.Scheme == "" {
+		if strings.HasPrefix(u, "//") {
+			u = "dns:" + u
+		} else {
+			u = "dns://" + u
+		}
+		return parseResolverURL(u)
+	}
+	parsed.Scheme = strings.ToLower(parsed.Scheme)
+	return u, parsed, nil
+}
+
+// ResolverOverProxy checks if resolver specified by URL can be used through
+// base proxy. Plain DNS resolvers can, but their queries switch to TCP.
+func ResolverOverProxy(u string) (tcp bool, err error) {
+	_, parsed, err := parseResolverURL(u)
+	if err != nil {
+		return false, err
+	}
+	switch parsed.Scheme {
+	case "udp", "dns":
+		return true, nil
+	case "http":
+		return false, PlainDoHOverProxyError
+	case "quic", "doq", "h3":
+		return false, QUICOverProxyError
+	}
+	return false, nil
+}
+
 type LookupNetIPer interface {
 	LookupNetIP(context.Context, string, string) ([]netip.Addr, error)
 }
 
+const (
+	RESOLVER_STRATEGY_RACE_ALL   = "race-all"
+	RESOLVER_STRATEGY_RACE_TOP   = "race-top"
+	RESOLVER_STRATEGY_SEQUENTIAL = "sequential"
+	RESOLVER_STRATEGY_RANDOM     = "random"
+)
+
+const (
+	RESOLVER_BENCH_FAILURES   = 3
+	RESOLVER_ATTEMPT_TIMEOUT  = 5 * time.Second
+	RESOLVER_LATENCY_EWMA     = 0.3
+	DEFAULT_RESOLVER_RACE_TOP = 2
+)
+
+type FastResolverConfig struct {
+	Strategy string
+	// Number of fastest upstreams raced by race-top strategy
+	RaceTop int
+	// Upstream failing RESOLVER_BENCH_FAILURES times in a row is not used
+	// for BenchInitial, doubling with each further failure up to BenchMax.
+	BenchInitial time.Duration
+	BenchMax     time.Duration
+	// Answers are validated with DNSSEC if trust anchors are set
+	TrustAnchors []*dns.DS
+}
+
+func ValidResolverStrategy(name string) bool {
+	switch name {
+	case RESOLVER_STRATEGY_RACE_ALL, RESOLVER_STRATEGY_RACE_TOP, RESOLVER_STRATEGY_SEQUENTIAL, RESOLVER_STRATEGY_RANDOM:
+		return true
+	}
+	return false
+}
+
+type ResolverUpstreamStats struct {
+	Name         string    `json:"name"`
+	Successes    uint64    `json:"successes"`
+	Failures     uint64    `json:"failures"`
+	SuccessRate  float64   `json:"success_rate"`
+	LatencyMs    float64   `json:"latency_ms"`
+	BenchedUntil time.Time `json:"benched_until,omitempty"`
+}
+
+type resolverUpstream struct {
+	name     string
+	resolver LookupNetIPer
+
+	mux          sync.Mutex
+	successes    uint64
+	failures     uint64
+	latency      time.Duration
+	failStreak   int
+	bench        time.Duration
+	benchedUntil time.Time
+}
+
+func (u *resolverUpstream) benched(now time.Time) bool {
+	u.mux.Lock()
+	defer u.mux.Unlock()
+	return now.Before(u.benchedUntil)
+}
+
+func (u *resolverUpstream) score() time.Duration {
+	u.mux.Lock()
+	defer u.mux.Unlock()
+	return u.latency
+}
+
+func (u *resolverUpstream) Stats() ResolverUpstreamStats {
+	u.mux.Lock()
+	defer u.mux.Unlock()
+	stats := ResolverUpstreamStats{
+		Name:      u.name,
+		Successes: u.successes,
+		Failures:  u.failures,
+		LatencyMs: float64(u.latency) / float64(time.Millisecond),
+	}
+	if total := u.successes + u.failures; total > 0 {
+		stats.SuccessRate = float64(u.successes) / float64(total)
+	}
+	if time.Now().Before(u.benchedUntil) {
+		stats.BenchedUntil = u.benchedUntil
+	}
+	return stats
+}
+
+// FastResolver spreads lookups across upstream resolvers according to
+// selected strategy and keeps track of their health.
 type FastResolver struct {
-	upstreams []LookupNetIPer
+	cfg       FastResolverConfig
+	logger    *CondLogger
+	upstreams []*resolverUpstream
 }
 
-func FastResolverFromURLs(urls ...string) (LookupNetIPer, error) {
-	resolvers := make([]LookupNetIPer, 0, len(urls))
+type NamedResolver struct {
+	Name     string
+	Resolver LookupNetIPer
+}
+
+func FastResolverFromURLs(dialer ContextDialer, cfg FastResolverConfig, logger *CondLogger, urls ...string) (*FastResolver, error) {
+	resolvers := make([]NamedResolver, 0, len(urls))
 	for i, u := range urls {
-		res, err := FromURL(u)
+		res, err := FromURL(u, dialer)
 		if err != nil {
 			return nil, fmt.Errorf("unable to construct resolver #%d (%q): %w", i, u, err)
 		}
-		resolvers = append(resolvers, res)
-	}
-	if len(resolvers) == 1 {
-		return resolvers[0], nil
+		if len(cfg.TrustAnchors) > 0 {
+			res = res.Validating(cfg.TrustAnchors)
+		}
+		resolvers = append(resolvers, NamedResolver{u, res})
 	}
-	return NewFastResolver(resolvers...), nil
+	return NewFastResolver(cfg, logger, resolvers...), nil
 }
 
-func NewFastResolver(resolvers ...LookupNetIPer) *FastResolver {
+func NewFastResolver(cfg FastResolverConfig, logger *CondLogger, resolvers ...NamedResolver) *FastResolver {
+	upstreams := make([]*resolverUpstream, 0, len(resolvers))
+	for _, res := range resolvers {
+		upstreams = append(upstreams, &resolverUpstream{
+			name:     res.Name,
+			resolver: res.Resolver,
+		})
+	}
 	return &FastResolver{
-		upstreams: resolvers,
+		cfg:       cfg,
+		logger:    logger,
+		upstreams: upstreams,
+	}
+}
+
+func (r *FastResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	addrs, _, err := r.LookupNetIPTTL(ctx, network, host)
+	return addrs, err
+}
+
+func (r *FastResolver) LookupNetIPTTL(ctx context.Context, network, host string) ([]netip.Addr, time.Duration, error) {
+	candidates := r.candidates()
+	switch r.cfg.Strategy {
+	case RESOLVER_STRATEGY_RACE_TOP:
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return candidates[i].score() < candidates[j].score()
+		})
+		if r.cfg.RaceTop > 0 && len(candidates) > r.cfg.RaceTop {
+			candidates = candidates[:r.cfg.RaceTop]
+		}
+		return r.race(ctx, candidates, network, host)
+	case RESOLVER_STRATEGY_SEQUENTIAL:
+		return r.sequential(ctx, candidates, network, host)
+	case RESOLVER_STRATEGY_RANDOM:
+		rand.New(RandomSource).Shuffle(len(candidates), func(i, j int) {
+			candidates[i], candidates[j] = candidates[j], candidates[i]
+		})
+		return r.sequential(ctx, candidates, network, host)
+	default:
+		return r.race(ctx, candidates, network, host)
+	}
+}
+
+// candidates returns upstreams which are not benched, or all upstreams if
+// every one is benched
+func (r *FastResolver) candidates() []*resolverUpstream {
+	now := time.Now()
+	res := make([]*resolverUpstream, 0, len(r.upstreams))
+	for _, up := range r.upstreams {
+		if !up.benched(now) {
+			res = append(res, up)
+		}
+	}
+	if len(res) == 0 {
+		res = append(res, r.upstreams...)
 	}
+	return res
 }
 
-func (r FastResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+// lookup queries single upstream and accounts result
+func (r *FastResolver) lookup(ctx context.Context, up *resolverUpstream, network, host string) ([]netip.Addr, time.Duration, error) {
+	start := time.Now()
+	addrs, ttl, err := lookupTTL(ctx, up.resolver, network, host)
+	var dnsErr *net.DNSError
+	switch {
+	case err == nil || errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+		r.reportSuccess(up, time.Since(start))
+	case ctx.Err() != nil:
+		// Lookup was abandoned by us, it says nothing about upstream
+	case errors.Is(err, DNSSECBogusError):
+		// Upstream has delivered answer, zone or path is to blame
+	default:
+		r.reportFailure(up, err)
+	}
+	return addrs, ttl, err
+}
+
+func (r *FastResolver) reportSuccess(up *resolverUpstream, latency time.Duration) {
+	up.mux.Lock()
+	up.successes++
+	if up.latency == 0 {
+		up.latency = latency
+	} else {
+		up.latency = time.Duration(RESOLVER_LATENCY_EWMA*float64(latency) + (1-RESOLVER_LATENCY_EWMA)*float64(up.latency))
+	}
+	recovered := up.failStreak >= RESOLVER_BENCH_FAILURES
+	up.failStreak = 0
+	up.bench = 0
+	up.benchedUntil = time.Time{}
+	up.mux.Unlock()
+	if recovered {
+		r.logger.Info("Resolver %s recovered", up.name)
+	}
+}
+
+func (r *FastResolver) reportFailure(up *resolverUpstream, err error) {
+	up.mux.Lock()
+	up.failures++
+	up.failStreak++
+	if up.failStreak < RESOLVER_BENCH_FAILURES {
+		up.mux.Unlock()
+		r.logger.Debug("Resolver %s failed: %v", up.name, err)
+		return
+	}
+	if up.bench == 0 {
+		up.bench = r.cfg.BenchInitial
+	} else {
+		up.bench = min(2*up.bench, r.cfg.BenchMax)
+	}
+	bench := up.bench
+	up.benchedUntil = time.Now().Add(bench)
+	streak := up.failStreak
+	up.mux.Unlock()
+	r.logger.Warning("Resolver %s benched for %v after %d consecutive failures. Last error: %v", up.name, bench, streak, err)
+}
+
+func (r *FastResolver) race(ctx context.Context, upstreams []*resolverUpstream, network, host string) ([]netip.Addr, time.Duration, error) {
+	type answer struct {
+		addrs []netip.Addr
+		ttl   time.Duration
+	}
 	ctx, cl := context.WithCancel(ctx)
 	defer cl()
 	errors := make(chan error)
-	success := make(chan []netip.Addr)
-	for _, res := range r.upstreams {
-		go func(res LookupNetIPer) {
-			addrs, err := res.LookupNetIP(ctx, network, host)
+	success := make(chan answer)
+	for _, up := range upstreams {
+		go func(up *resolverUpstream) {
+			addrs, ttl, err := r.lookup(ctx, up, network, host)
 			if err == nil {
 				select {
-				case success <- addrs:
+				case success <- answer{addrs, ttl}:
 				case <-ctx.Done():
 				}
 			} else {
@@ -112,36 +360,98 @@ func (r FastResolver) LookupNetIP(ctx context.Context, network, host string) ([]
 				case <-ctx.Done():
 				}
 			}
-		}(res)
+		}(up)
 	}
 
 	var resErr error
-	for _ = range r.upstreams {
+	for _ = range upstreams {
 		select {
 		case <-ctx.Done():
-			return nil, ctx.Err()
-		case resAddrs := <-success:
-			return resAddrs, nil
+			return nil, 0, ctx.Err()
+		case ans := <-success:
+			return ans.addrs, ans.ttl, nil
 		case err := <-errors:
 			resErr = multierror.Append(resErr, err)
 		}
 	}
-	return nil, resErr
+	return nil, 0, resErr
+}
+
+// sequential tries upstreams one by one until one of them answers
+func (r *FastResolver) sequential(ctx context.Context, upstreams []*resolverUpstream, network, host string) ([]netip.Addr, time.Duration, error) {
+	var resErr error
+	for i, up := range upstreams {
+		attemptCtx, cl := ctx, context.CancelFunc(func() {})
+		if i < len(upstreams)-1 {
+			// Leave time for the rest
+			attemptCtx, cl = context.WithTimeout(ctx, RESOLVER_ATTEMPT_TIMEOUT)
+		}
+		addrs, ttl, err := r.lookup(attemptCtx, up, network, host)
+		cl()
+		var dnsErr *net.DNSError
+		if err == nil || errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return addrs, ttl, err
+		}
+		if ctx.Err() != nil {
+			return nil, 0, ctx.Err()
+		}
+		resErr = multierror.Append(resErr, err)
+	}
+	return nil, 0, resErr
 }
 
-func NewPlainResolver(addr string) *net.Resolver {
-	return &net.Resolver{
+func (r *FastResolver) Stats() []ResolverUpstreamStats {
+	res := make([]ResolverUpstreamStats, 0, len(r.upstreams))
+	for _, up := range r.upstreams {
+		res = append(res, up.Stats())
+	}
+	return res
+}
+
+// DNSExchanger delivers DNS query to server and returns its response
+type DNSExchanger interface {
+	Exchange(ctx context.Context, query []byte) ([]byte, error)
+}
+
+// resolverExchanger speaks DNS protocol over connections provided by Dial
+// of wrapped resolver. Query is repeated over TCP if UDP response is
+// truncated.
+type resolverExchanger struct {
+	*net.Resolver
+}
+
+func (e resolverExchanger) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	resp, err := exchangeDNS(ctx, func(ctx context.Context) (net.Conn, error) {
+		return e.Dial(ctx, "udp", "")
+	}, query)
+	if err == nil && len(resp) > 2 && resp[2]&0x02 != 0 {
+		return exchangeDNS(ctx, func(ctx context.Context) (net.Conn, error) {
+			return e.Dial(ctx, "tcp", "")
+		}, query)
+	}
+	return resp, err
+}
+
+// NewPlainResolver creates resolver for DNS server at addr. Queries are sent
+// over UDP if resolver is direct and over TCP through base proxy dialer,
+// because proxies can only carry streams.
+func NewPlainResolver(addr string, dialer ContextDialer) *MessageResolver {
+	if dialer != nil {
+		return NewTCPResolver(addr, dialer)
+	}
+	return NewMessageResolver(resolverExchanger{&net.Resolver{
 		PreferGo: true,
 		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
 			return (&net.Dialer{
 				Resolver: &net.Resolver{},
 			}).DialContext(ctx, network, addr)
 		},
-	}
+	}})
 }
 
-func NewTCPResolver(addr string) *net.Resolver {
-	return &net.Resolver{
+func NewTCPResolver(addr string, dialer ContextDialer) *MessageResolver {
+	dialer = dialerOrDirect(dialer)
+	return NewMessageResolver(resolverExchanger{&net.Resolver{
 		PreferGo: true,
 		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
 			dnet := "tcp"
@@ -151,9 +461,100 @@ func NewTCPResolver(addr string) *net.Resolver {
 			case "udp6":
 				dnet = "tcp6"
 			}
-			return (&net.Dialer{
-				Resolver: &net.Resolver{},
-			}).DialContext(ctx, dnet, addr)
+			return dialer.DialContext(ctx, dnet, addr)
 		},
+	}})
+}
+
+func dialerOrDirect(dialer ContextDialer) ContextDialer {
+	if dialer == nil {
+		return &net.Dialer{
+			Resolver: &net.Resolver{},
+		}
+	}
+	return dialer
+}
+
+// NewDoTResolver creates DNS-over-TLS resolver for server at addr. If
+// tlsConfig is nil, server certificate is verified against host part of
+// addr.
+func NewDoTResolver(addr string, dialer ContextDialer, tlsConfig *stdtls.Config) (*MessageResolver, error) {
+	opts := []godns.DoTOption{godns.DoTAddresses(addr)}
+	if dialer != nil {
+		opts = append(opts, godns.DoTDialFunc(dialer.DialContext))
+	}
+	if tlsConfig != nil {
+		opts = append(opts, godns.DoTConfig(tlsConfig))
+	}
+	res, err := godns.NewDoTResolver(addr, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return NewMessageResolver(resolverExchanger{res}), nil
+}
+
+// NewDoHResolver creates DNS-over-HTTPS resolver for endpoint at uri.
+// tlsConfig may be nil. Endpoint without TLS can't be reached through base
+// proxy dialer.
+func NewDoHResolver(uri string, dialer ContextDialer, tlsConfig *stdtls.Config) (*MessageResolver, error) {
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	port := parsed.Port()
+	if port == "" {
+		if parsed.Scheme == "http" {
+			port = "80"
+		} else {
+			port = "443"
+		}
+	}
+	opts := []godns.DoHOption{godns.DoHAddresses(net.JoinHostPort(parsed.Hostname(), port))}
+	if dialer != nil || tlsConfig != nil {
+		transport := &http.Transport{
+			TLSClientConfig:     tlsConfig,
+			MaxIdleConns:        http.DefaultMaxIdleConnsPerHost,
+			IdleConnTimeout:     90 * time.Second,
+			TLSHandshakeTimeout: 10 * time.Second,
+			ForceAttemptHTTP2:   true,
+		}
+		if dialer != nil {
+			if parsed.Scheme == "http" {
+				return nil, PlainDoHOverProxyError
+			}
+			// Resolver library dials HTTP connections directly, so TLS
+			// connections are established on its behalf
+			transport.DialTLSContext = dohDialTLS(dialer, parsed.Hostname(), tlsConfig)
+		}
+		opts = append(opts, godns.DoHTransport(transport))
+	}
+	res, err := godns.NewDoHResolver(uri, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return NewMessageResolver(resolverExchanger{res}), nil
+}
+
+func dohDialTLS(dialer ContextDialer, host string, tlsConfig *stdtls.Config) func(context.Context, string, string) (net.Conn, error) {
+	if tlsConfig == nil {
+		tlsConfig = &stdtls.Config{}
+	} else {
+		tlsConfig = tlsConfig.Clone()
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = host
+	}
+	tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		tlsConn := stdtls.Client(conn, tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
 	}
 }
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+var errResolverDown = errors.New("resolver is down")
+
+func newTestFastResolver(t *testing.T, strategy string, upstreams ...*countingResolver) *FastResolver {
+	named := make([]NamedResolver, 0, len(upstreams))
+	for i, up := range upstreams {
+		named = append(named, NamedResolver{string(rune('a' + i)), up})
+	}
+	return NewFastResolver(FastResolverConfig{
+		Strategy:     strategy,
+		RaceTop:      1,
+		BenchInitial: time.Hour,
+		BenchMax:     time.Hour,
+	}, testLogger(t, "DNS     : "), named...)
+}
+
+func newTestUpstream(delay time.Duration, down bool) *countingResolver {
+	r := &countingResolver{
+		records: map[string][]netip.Addr{"example.test": {netip.MustParseAddr("192.0.2.1")}},
+		delay:   delay,
+	}
+	if down {
+		r.err = errResolverDown
+	}
+	return r
+}
+
+func TestFastResolverSequential(t *testing.T) {
+	down, up, spare := newTestUpstream(0, true), newTestUpstream(0, false), newTestUpstream(0, false)
+	r := newTestFastResolver(t, RESOLVER_STRATEGY_SEQUENTIAL, down, up, spare)
+	for i := 0; i < RESOLVER_BENCH_FAILURES+1; i++ {
+		if _, err := r.LookupNetIP(context.Background(), "ip", "example.test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if down.calls.Load() != RESOLVER_BENCH_FAILURES {
+		t.Errorf("failing resolver called %d times, want %d", down.calls.Load(), RESOLVER_BENCH_FAILURES)
+	}
+	if spare.calls.Load() != 0 {
+		t.Errorf("spare resolver called %d times", spare.calls.Load())
+	}
+	stats := r.Stats()
+	if stats[0].BenchedUntil.IsZero() || stats[0].SuccessRate != 0 {
+		t.Errorf("failing resolver is not benched: %+v", stats[0])
+	}
+	if stats[1].Successes != RESOLVER_BENCH_FAILURES+1 || stats[1].SuccessRate != 1 {
+		t.Errorf("unexpected stats of working resolver: %+v", stats[1])
+	}
+}
+
+func TestFastResolverAllBenched(t *testing.T) {
+	down := newTestUpstream(0, true)
+	r := newTestFastResolver(t, RESOLVER_STRATEGY_RANDOM, down)
+	for i := 0; i < RESOLVER_BENCH_FAILURES+1; i++ {
+		r.LookupNetIP(context.Background(), "ip", "example.test")
+	}
+	if down.calls.Load() != RESOLVER_BENCH_FAILURES+1 {
+		t.Errorf("sole resolver called %d times, want %d", down.calls.Load(), RESOLVER_BENCH_FAILURES+1)
+	}
+}
+
+func TestFastResolverBogusNotBenched(t *testing.T) {
+	bogus := newTestUpstream(0, false)
+	bogus.err = fmt.Errorf("lookup example.test: %w", DNSSECBogusError)
+	r := newTestFastResolver(t, RESOLVER_STRATEGY_SEQUENTIAL, bogus, newTestUpstream(0, false))
+	for i := 0; i < RESOLVER_BENCH_FAILURES+1; i++ {
+		if _, err := r.LookupNetIP(context.Background(), "ip", "example.test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if bogus.calls.Load() != RESOLVER_BENCH_FAILURES+1 {
+		t.Errorf("resolver delivering bogus answers called %d times, want %d", bogus.calls.Load(), RESOLVER_BENCH_FAILURES+1)
+	}
+	if stats := r.Stats(); !stats[0].BenchedUntil.IsZero() {
+		t.Errorf("resolver delivering bogus answers is benched: %+v", stats[0])
+	}
+}
+
+func TestFastResolverRaceTop(t *testing.T) {
+	slow, fast := newTestUpstream(50*time.Millisecond, false), newTestUpstream(0, false)
+	r := newTestFastResolver(t, RESOLVER_STRATEGY_RACE_TOP, slow, fast)
+	// Resolvers with unknown latency are tried first
+	for i := 0; i < 2; i++ {
+		if _, err := r.LookupNetIP(context.Background(), "ip", "example.test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if slow.calls.Load() != 1 || fast.calls.Load() != 1 {
+		t.Fatalf("resolvers are not probed: %+v", r.Stats())
+	}
+	slowCalls := slow.calls.Load()
+	for i := 0; i < 3; i++ {
+		if _, err := r.LookupNetIP(context.Background(), "ip", "example.test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if slow.calls.Load() != slowCalls {
+		t.Errorf("slow resolver is raced: %+v", r.Stats())
+	}
+}
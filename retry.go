@@ -4,23 +4,49 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"net/netip"
+	"time"
 )
 
+const (
+	FAMILY_ANY  = "any"
+	FAMILY_IPV4 = "ipv4"
+	FAMILY_IPV6 = "ipv6"
+)
+
+// Delay before next connection attempt to resolved address is started
+// in parallel, RFC 8305 section 5
+const CONNECTION_ATTEMPT_DELAY = 250 * time.Millisecond
+
 type RetryDialer struct {
 	dialer   ContextDialer
 	resolver LookupNetIPer
+	blocked  *BlockedHosts
+	family   string
 	logger   *CondLogger
 }
 
-func NewRetryDialer(dialer ContextDialer, resolver LookupNetIPer, logger *CondLogger) *RetryDialer {
+// NewRetryDialer creates dialer which resolves and tunnels destinations
+// blocked by upstream. blocked may be nil, then nothing is learned and each
+// connection to blocked host is attempted by name first. Resolved addresses
+// of family are tried first.
+func NewRetryDialer(dialer ContextDialer, resolver LookupNetIPer, blocked *BlockedHosts, family string, logger *CondLogger) *RetryDialer {
 	return &RetryDialer{
 		dialer:   dialer,
 		resolver: resolver,
+		blocked:  blocked,
+		family:   family,
 		logger:   logger,
 	}
 }
 
 func (d *RetryDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err == nil && d.blocked != nil && net.ParseIP(host) == nil && d.blocked.Blocked(host) {
+		d.logger.Debug("Destination %s is known to be blocked by upstream. Using resolve&tunnel workaround.", address)
+		d.emit(ctx, EVENT_RESOLVE_FALLBACK, host, port, "known_blocked")
+		return d.resolveAndDial(ctx, network, host, port)
+	}
 	conn, err := d.dialer.DialContext(ctx, network, address)
 	if err == UpstreamBlockedError {
 		d.logger.Info("Destination %s blocked by upstream. Rescuing it with resolve&tunnel workaround.", address)
@@ -28,33 +54,149 @@ func (d *RetryDialer) DialContext(ctx context.Context, network, address string)
 		if err1 != nil {
 			return conn, err
 		}
-
-		var resolveNetwork string
-		switch network {
-		case "udp4", "tcp4", "ip4":
-			resolveNetwork = "ip4"
-		case "udp6", "tcp6", "ip6":
-			resolveNetwork = "ip6"
-		case "udp", "tcp", "ip":
-			resolveNetwork = "ip"
-		default:
-			return nil, fmt.Errorf("resolving dial %q: unsupported network %q", address, network)
-		}
-		resolved, err := d.resolver.LookupNetIP(ctx, resolveNetwork, host)
-		if err != nil {
-			return nil, fmt.Errorf("dial failed on address lookup: %w", err)
+		d.emit(ctx, EVENT_HOST_BLOCKED, host, port, "")
+		if d.blocked != nil {
+			d.blocked.Learn(host)
 		}
+		d.emit(ctx, EVENT_RESOLVE_FALLBACK, host, port, "blocked")
+		return d.resolveAndDial(ctx, network, host, port)
+	}
+	return conn, err
+}
 
-		var conn net.Conn
-		for _, ip := range resolved {
-			conn, err = d.dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
-			if err == nil {
-				return conn, nil
+// emit notifies about destination blocked by upstream selected for
+// connection, if any.
+func (d *RetryDialer) emit(ctx context.Context, typ, host, port, reason string) {
+	data := map[string]string{
+		"host": host,
+		"port": port,
+	}
+	if reason != "" {
+		data["reason"] = reason
+	}
+	if up, ok := upstreamFromContext(ctx); ok {
+		data["name"] = up.Name
+	}
+	events.Emit(typ, data)
+}
+
+func (d *RetryDialer) resolveAndDial(ctx context.Context, network, host, port string) (net.Conn, error) {
+	var resolveNetwork string
+	switch network {
+	case "udp4", "tcp4", "ip4":
+		resolveNetwork = "ip4"
+	case "udp6", "tcp6", "ip6":
+		resolveNetwork = "ip6"
+	case "udp", "tcp", "ip":
+		resolveNetwork = "ip"
+	default:
+		return nil, fmt.Errorf("resolving dial %q: unsupported network %q", net.JoinHostPort(host, port), network)
+	}
+	resolved, err := d.resolver.LookupNetIP(ctx, resolveNetwork, host)
+	if err != nil {
+		return nil, fmt.Errorf("dial failed on address lookup: %w", err)
+	}
+
+	if len(resolved) == 0 {
+		return nil, fmt.Errorf("failed to dial %s: no addresses found", net.JoinHostPort(host, port))
+	}
+	conn, err := d.dialParallel(ctx, network, sortAddrs(resolved, d.family), port)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial %s: %w", net.JoinHostPort(host, port), err)
+	}
+	return conn, nil
+}
+
+// dialParallel makes staggered connection attempts to addrs in their order,
+// starting next one after CONNECTION_ATTEMPT_DELAY or once previous attempt
+// fails. First established connection wins, the rest are cancelled.
+func (d *RetryDialer) dialParallel(ctx context.Context, network string, addrs []netip.Addr, port string) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	ctx, cl := context.WithCancel(ctx)
+	defer cl()
+	results := make(chan result)
+	start := func(addr netip.Addr) {
+		go func() {
+			conn, err := d.dialer.DialContext(ctx, network, net.JoinHostPort(addr.Unmap().String(), port))
+			select {
+			case results <- result{conn, err}:
+			case <-ctx.Done():
+				if conn != nil {
+					conn.Close()
+				}
 			}
+		}()
+	}
+
+	start(addrs[0])
+	next, pending := 1, 1
+	timer := time.NewTimer(CONNECTION_ATTEMPT_DELAY)
+	defer timer.Stop()
+	var lastErr error
+	for pending > 0 {
+		select {
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				return res.conn, nil
+			}
+			lastErr = res.err
+			if next < len(addrs) {
+				d.logger.Debug("Attempt to connect %s failed: %v. Trying next address.", addrs[next-1], res.err)
+				start(addrs[next])
+				next++
+				pending++
+				timer.Reset(CONNECTION_ATTEMPT_DELAY)
+			}
+		case <-timer.C:
+			if next < len(addrs) {
+				start(addrs[next])
+				next++
+				pending++
+				timer.Reset(CONNECTION_ATTEMPT_DELAY)
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
 		}
-		return nil, fmt.Errorf("failed to dial %s: %w", address, err)
 	}
-	return conn, err
+	return nil, lastErr
+}
+
+// sortAddrs orders addresses for connection attempts: families interleave
+// starting with preferred one (RFC 8305 section 4), or with family of the
+// first address if there is no preference.
+func sortAddrs(addrs []netip.Addr, family string) []netip.Addr {
+	var v4, v6 []netip.Addr
+	for _, addr := range addrs {
+		if addr.Unmap().Is4() {
+			v4 = append(v4, addr)
+		} else {
+			v6 = append(v6, addr)
+		}
+	}
+	first, second := v4, v6
+	switch family {
+	case FAMILY_IPV6:
+		first, second = v6, v4
+	case FAMILY_IPV4:
+	default:
+		if len(addrs) > 0 && !addrs[0].Unmap().Is4() {
+			first, second = v6, v4
+		}
+	}
+	res := make([]netip.Addr, 0, len(addrs))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			res = append(res, first[i])
+		}
+		if i < len(second) {
+			res = append(res, second[i])
+		}
+	}
+	return res
 }
 
 func (d *RetryDialer) Dial(network, address string) (net.Conn, error) {
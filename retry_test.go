@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSortAddrs(t *testing.T) {
+	addrs := []netip.Addr{
+		netip.MustParseAddr("2001:db8::1"),
+		netip.MustParseAddr("2001:db8::2"),
+		netip.MustParseAddr("2001:db8::3"),
+		netip.MustParseAddr("192.0.2.1"),
+		netip.MustParseAddr("192.0.2.2"),
+	}
+	for family, want := range map[string]string{
+		FAMILY_ANY:  "[2001:db8::1 192.0.2.1 2001:db8::2 192.0.2.2 2001:db8::3]",
+		FAMILY_IPV4: "[192.0.2.1 2001:db8::1 192.0.2.2 2001:db8::2 2001:db8::3]",
+		FAMILY_IPV6: "[2001:db8::1 192.0.2.1 2001:db8::2 192.0.2.2 2001:db8::3]",
+	} {
+		if got := fmt.Sprint(sortAddrs(addrs, family)); got != want {
+			t.Errorf("%s: got %s, want %s", family, got, want)
+		}
+	}
+}
+
+func TestRetryDialerHappyEyeballs(t *testing.T) {
+	target := startEchoServer(t)
+	_, port, _ := net.SplitHostPort(target)
+	var cancelled atomic.Bool
+	dialer := dialerFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, _, _ := net.SplitHostPort(address)
+		switch host {
+		case "blocked.test":
+			return nil, UpstreamBlockedError
+		case "192.0.2.1":
+			// Black hole
+			<-ctx.Done()
+			cancelled.Store(true)
+			return nil, ctx.Err()
+		case "192.0.2.2":
+			return nil, errors.New("connection refused")
+		}
+		return (&net.Dialer{}).DialContext(ctx, network, address)
+	})
+	resolver := staticResolver{"blocked.test": {
+		netip.MustParseAddr("192.0.2.1"),
+		netip.MustParseAddr("192.0.2.2"),
+		netip.MustParseAddr("127.0.0.1"),
+	}}
+	d := NewRetryDialer(dialer, resolver, nil, FAMILY_IPV4, testLogger(t, "RETRY   : "))
+	start := time.Now()
+	conn, err := d.DialContext(context.Background(), "tcp", net.JoinHostPort("blocked.test", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if elapsed := time.Since(start); elapsed > 2*CONNECTION_ATTEMPT_DELAY {
+		t.Errorf("connection took %v", elapsed)
+	}
+	deadline := time.Now().Add(time.Second)
+	for !cancelled.Load() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if !cancelled.Load() {
+		t.Error("losing attempt is not cancelled")
+	}
+}
+
+func TestRetryDialerAllAttemptsFail(t *testing.T) {
+	dialer := dialerFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, _, _ := net.SplitHostPort(address)
+		if host == "blocked.test" {
+			return nil, UpstreamBlockedError
+		}
+		return nil, errors.New("connection refused")
+	})
+	resolver := staticResolver{"blocked.test": {
+		netip.MustParseAddr("192.0.2.1"),
+		netip.MustParseAddr("2001:db8::1"),
+	}}
+	d := NewRetryDialer(dialer, resolver, nil, FAMILY_ANY, testLogger(t, "RETRY   : "))
+	if _, err := d.DialContext(context.Background(), "tcp", "blocked.test:80"); err == nil {
+		t.Fatal("dial succeeded")
+	}
+	if _, err := d.DialContext(context.Background(), "tcp", "unknown.test:80"); err == nil {
+		t.Fatal("dial without addresses succeeded")
+	}
+}
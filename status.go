@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+)
+
+// StatusServer serves JSON document composed of sections reported by
+// registered providers.
+type StatusServer struct {
+	mux      sync.Mutex
+	names    []string
+	sections map[string]func() interface{}
+}
+
+func NewStatusServer() *StatusServer {
+	return &StatusServer{
+		sections: make(map[string]func() interface{}),
+	}
+}
+
+func (s *StatusServer) Register(name string, provider func() interface{}) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if _, ok := s.sections[name]; !ok {
+		s.names = append(s.names, name)
+	}
+	s.sections[name] = provider
+}
+
+func (s *StatusServer) Snapshot() map[string]interface{} {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	res := make(map[string]interface{}, len(s.names))
+	for _, name := range s.names {
+		res[name] = s.sections[name]()
+	}
+	return res
+}
+
+func (s *StatusServer) ServeHTTP(wr http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		http.Error(wr, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	wr.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(wr)
+	enc.SetIndent("", "  ")
+	enc.Encode(s.Snapshot())
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync/atomic"
+)
+
+// SwitchDialer dials through one of alternative dialers at a time.
+type SwitchDialer struct {
+	dialers []ContextDialer
+	current atomic.Int64
+}
+
+func NewSwitchDialer(dialers ...ContextDialer) *SwitchDialer {
+	return &SwitchDialer{
+		dialers: dialers,
+	}
+}
+
+// Switch makes next dialer current and returns its index.
+func (d *SwitchDialer) Switch() int {
+	idx := int(d.current.Add(1) % int64(len(d.dialers)))
+	events.Emit(EVENT_BASE_PROXY_CHANGED, map[string]string{
+		"index": strconv.Itoa(idx),
+	})
+	return idx
+}
+
+func (d *SwitchDialer) Current() int {
+	return int(d.current.Load() % int64(len(d.dialers)))
+}
+
+func (d *SwitchDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return d.dialers[d.Current()].DialContext(ctx, network, address)
+}
+
+func (d *SwitchDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
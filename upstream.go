@@ -2,17 +2,19 @@ package main
 
 import (
 	"bufio"
-	"bytes"
 	"context"
 	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"os"
 	"strings"
+	"time"
 
 	tls "github.com/refraction-networking/utls"
 )
@@ -21,9 +23,12 @@ const (
 	PROXY_CONNECT_METHOD       = "CONNECT"
 	PROXY_HOST_HEADER          = "Host"
 	PROXY_AUTHORIZATION_HEADER = "Proxy-Authorization"
+	MAX_RESPONSE_HEADER_SIZE   = 64 * 1024
 )
 
 var UpstreamBlockedError = errors.New("blocked by upstream")
+var UpstreamAuthError = errors.New("upstream proxy rejected credentials")
+var ResponseHeaderTooLongError = errors.New("upstream proxy response header is too long")
 
 type Dialer interface {
 	Dial(network, address string) (net.Conn, error)
@@ -35,26 +40,32 @@ type ContextDialer interface {
 }
 
 type ProxyDialer struct {
-	address       string
-	tlsServerName string
-	auth          AuthProvider
-	next          ContextDialer
-	caPool        *x509.CertPool
-	hideSNI       bool
+	address        string
+	tlsServerName  string
+	auth           AuthProvider
+	next           ContextDialer
+	caPool         *x509.CertPool
+	hideSNI        bool
+	connectTimeout time.Duration
 }
 
-func NewProxyDialer(address, tlsServerName string, caPool *x509.CertPool, auth AuthProvider, hideSNI bool, nextDialer ContextDialer) *ProxyDialer {
+// NewProxyDialer returns dialer which establishes tunnels through HTTP(S)
+// proxy. Non-zero connectTimeout limits whole tunnel setup in addition to
+// deadline of dial context.
+func NewProxyDialer(address, tlsServerName string, caPool *x509.CertPool, auth AuthProvider, hideSNI bool,
+	connectTimeout time.Duration, nextDialer ContextDialer) *ProxyDialer {
 	return &ProxyDialer{
-		address:       address,
-		tlsServerName: tlsServerName,
-		auth:          auth,
-		next:          nextDialer,
-		caPool:        caPool,
-		hideSNI:       hideSNI,
+		address:        address,
+		tlsServerName:  tlsServerName,
+		auth:           auth,
+		next:           nextDialer,
+		caPool:         caPool,
+		hideSNI:        hideSNI,
+		connectTimeout: connectTimeout,
 	}
 }
 
-func ProxyDialerFromURL(u *url.URL, caPool *x509.CertPool, next ContextDialer) (*ProxyDialer, error) {
+func ProxyDialerFromURL(u *url.URL, caPool *x509.CertPool, connectTimeout time.Duration, next ContextDialer) (*ProxyDialer, error) {
 	host := u.Hostname()
 	port := u.Port()
 	tlsServerName := ""
@@ -84,7 +95,7 @@ func ProxyDialerFromURL(u *url.URL, caPool *x509.CertPool, next ContextDialer) (
 			return authHeader
 		}
 	}
-	return NewProxyDialer(address, tlsServerName, caPool, auth, false, next), nil
+	return NewProxyDialer(address, tlsServerName, caPool, auth, false, connectTimeout, next), nil
 }
 
 func (d *ProxyDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
@@ -94,9 +105,15 @@ func (d *ProxyDialer) DialContext(ctx context.Context, network, address string)
 		return nil, errors.New("bad network specified for DialContext: only tcp is supported")
 	}
 
+	if d.connectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.connectTimeout)
+		defer cancel()
+	}
+
 	conn, err := d.next.DialContext(ctx, "tcp", d.address)
 	if err != nil {
-		return nil, err
+		return nil, d.stageError(ctx, "dial", err)
 	}
 
 	if d.tlsServerName != "" {
@@ -107,22 +124,18 @@ func (d *ProxyDialer) DialContext(ctx context.Context, network, address string)
 		if d.hideSNI {
 			sni = ""
 		}
-		conn = tls.UClient(conn, &tls.Config{
+		tlsConn := tls.UClient(conn, &tls.Config{
 			ServerName:         sni,
 			InsecureSkipVerify: true,
 			VerifyConnection: func(cs tls.ConnectionState) error {
-				opts := x509.VerifyOptions{
-					DNSName:       d.tlsServerName,
-					Intermediates: x509.NewCertPool(),
-					Roots:         d.caPool,
-				}
-				for _, cert := range cs.PeerCertificates[1:] {
-					opts.Intermediates.AddCert(cert)
-				}
-				_, err := cs.PeerCertificates[0].Verify(opts)
-				return err
+				return verifyPeerCertificates(cs.PeerCertificates, d.tlsServerName, d.caPool)
 			},
 		}, tls.HelloAndroid_11_OkHttp)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, d.stageError(ctx, "TLS handshake", err)
+		}
+		conn = tlsConn
 	}
 
 	req := &http.Request{
@@ -143,57 +156,174 @@ func (d *ProxyDialer) DialContext(ctx context.Context, network, address string)
 
 	rawreq, err := httputil.DumpRequest(req, false)
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
 
-	_, err = conn.Write(rawreq)
+	err = withConnContext(ctx, conn, func() error {
+		_, err := conn.Write(rawreq)
+		return err
+	})
 	if err != nil {
-		return nil, err
+		conn.Close()
+		return nil, d.stageError(ctx, "CONNECT request", err)
 	}
 
-	proxyResp, err := readResponse(conn, req)
+	proxyResp, tunnel, err := readResponse(ctx, conn, req)
 	if err != nil {
-		return nil, err
+		conn.Close()
+		return nil, d.stageError(ctx, "CONNECT response", err)
 	}
 
 	if proxyResp.StatusCode != http.StatusOK {
+		conn.Close()
 		if proxyResp.StatusCode == http.StatusForbidden &&
 			proxyResp.Header.Get("X-Hola-Error") == "Forbidden Host" {
 			return nil, UpstreamBlockedError
 		}
+		if proxyResp.StatusCode == http.StatusProxyAuthRequired {
+			return nil, UpstreamAuthError
+		}
 		return nil, errors.New(fmt.Sprintf("bad response from upstream proxy server: %s", proxyResp.Status))
 	}
 
-	return conn, nil
+	return tunnel, nil
+}
+
+// stageError tells apart timeouts of tunnel setup from other failures
+func (d *ProxyDialer) stageError(ctx context.Context, stage string, err error) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		return &ConnectTimeoutError{
+			Stage:   stage,
+			Address: d.address,
+			Err:     err,
+		}
+	}
+	return err
+}
+
+// ConnectTimeoutError reports stage of tunnel setup which hasn't completed
+// in time
+type ConnectTimeoutError struct {
+	Stage   string
+	Address string
+	Err     error
+}
+
+func (e *ConnectTimeoutError) Error() string {
+	return fmt.Sprintf("upstream proxy %s: timeout during %s: %v", e.Address, e.Stage, e.Err)
+}
+
+func (e *ConnectTimeoutError) Unwrap() error {
+	return e.Err
+}
+
+func (e *ConnectTimeoutError) Timeout() bool {
+	return true
+}
+
+func (e *ConnectTimeoutError) Temporary() bool {
+	return true
 }
 
 func (d *ProxyDialer) Dial(network, address string) (net.Conn, error) {
 	return d.DialContext(context.Background(), network, address)
 }
 
-func readResponse(r io.Reader, req *http.Request) (*http.Response, error) {
-	endOfResponse := []byte("\r\n\r\n")
-	buf := &bytes.Buffer{}
-	b := make([]byte, 1)
-	for {
-		n, err := r.Read(b)
-		if n < 1 && err == nil {
-			continue
+// withConnContext bounds I/O on conn performed by fn with deadline and
+// cancellation of ctx
+func withConnContext(ctx context.Context, conn net.Conn, fn func() error) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+	err := fn()
+	if !stop() {
+		// Connection is spoiled by deadline in the past anyway
+		if err == nil {
+			return ctx.Err()
 		}
+		return fmt.Errorf("%w: %w", ctx.Err(), err)
+	}
+	conn.SetDeadline(time.Time{})
+	var netErr net.Error
+	if _, ok := ctx.Deadline(); ok && errors.As(err, &netErr) && netErr.Timeout() {
+		// Connection deadline may fire right before context is done
+		return fmt.Errorf("%w: %w", context.DeadlineExceeded, err)
+	}
+	return err
+}
 
-		buf.Write(b)
-		sl := buf.Bytes()
-		if len(sl) < len(endOfResponse) {
-			continue
-		}
+// readResponse reads response to CONNECT request from conn until ctx is
+// done. Returned connection has to be used for tunnel instead of conn: it
+// serves data which arrived right after response header.
+func readResponse(ctx context.Context, conn net.Conn, req *http.Request) (*http.Response, net.Conn, error) {
+	var (
+		resp *http.Response
+		br   *bufio.Reader
+	)
+	err := withConnContext(ctx, conn, func() error {
+		var err error
+		resp, br, err = parseResponse(conn, req)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if br.Buffered() == 0 {
+		return resp, conn, nil
+	}
+	return resp, &bufferedConn{
+		Conn: conn,
+		r:    br,
+	}, nil
+}
 
-		if bytes.Equal(sl[len(sl)-4:], endOfResponse) {
-			break
+// parseResponse reads response header from r, reading no more than
+// MAX_RESPONSE_HEADER_SIZE bytes. Returned reader may hold bytes past header.
+func parseResponse(r io.Reader, req *http.Request) (*http.Response, *bufio.Reader, error) {
+	lr := &io.LimitedReader{
+		R: r,
+		N: MAX_RESPONSE_HEADER_SIZE,
+	}
+	br := bufio.NewReader(lr)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		if lr.N <= 0 {
+			return nil, nil, ResponseHeaderTooLongError
+		}
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
 		}
+		return nil, nil, err
+	}
+	// Whatever follows header belongs to tunnel
+	lr.N = math.MaxInt64
+	return resp, br, nil
+}
 
-		if err != nil {
-			return nil, err
+// bufferedConn serves data buffered by reader before reading from
+// connection itself
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	if c.r != nil {
+		if c.r.Buffered() > 0 {
+			return c.r.Read(b)
 		}
+		c.r = nil
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
 	}
-	return http.ReadResponse(bufio.NewReader(buf), req)
+	return errors.ErrUnsupported
 }
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReadResponsePreservesTunnelData(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go io.WriteString(server, "HTTP/1.1 200 OK\r\n\r\nearly bird")
+
+	resp, tunnel, err := readResponse(context.Background(), client, &http.Request{Method: PROXY_CONNECT_METHOD})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %s", resp.Status)
+	}
+	buf := make([]byte, len("early bird"))
+	if _, err := io.ReadFull(tunnel, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "early bird" {
+		t.Errorf("got %q from tunnel, want %q", buf, "early bird")
+	}
+
+	go io.WriteString(server, "more")
+	buf = buf[:4]
+	if _, err := io.ReadFull(tunnel, buf); err != nil || string(buf) != "more" {
+		t.Errorf("got %q, %v after buffered data", buf, err)
+	}
+}
+
+func TestReadResponseContext(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, _, err := readResponse(ctx, client, &http.Request{Method: PROXY_CONNECT_METHOD})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got error %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("handshake wasn't interrupted in time: %v", elapsed)
+	}
+}
+
+// startStalledServer accepts connections and never answers
+func startStalledServer(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		mux   sync.Mutex
+		conns []net.Conn
+	)
+	t.Cleanup(func() {
+		l.Close()
+		mux.Lock()
+		defer mux.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	})
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			mux.Lock()
+			conns = append(conns, conn)
+			mux.Unlock()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestProxyDialerConnectTimeout(t *testing.T) {
+	addr := startStalledServer(t)
+	for _, tc := range []struct {
+		tlsServerName string
+		stage         string
+	}{
+		{"", "CONNECT response"},
+		{"zagent1.hola.org", "TLS handshake"},
+	} {
+		d := NewProxyDialer(addr, tc.tlsServerName, nil, nil, true, 100*time.Millisecond, &net.Dialer{})
+		start := time.Now()
+		_, err := d.DialContext(context.Background(), "tcp", "example.com:443")
+		var timeoutErr *ConnectTimeoutError
+		if !errors.As(err, &timeoutErr) {
+			t.Fatalf("got error %v, want %T", err, timeoutErr)
+		}
+		if timeoutErr.Stage != tc.stage {
+			t.Errorf("got timeout at stage %q, want %q", timeoutErr.Stage, tc.stage)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("dial wasn't interrupted in time: %v", elapsed)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"bufio"
 	"context"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/csv"
 	"errors"
@@ -16,6 +17,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -50,12 +52,137 @@ func basic_auth_header(login, password string) string {
 		[]byte(login+":"+password))
 }
 
-func proxy(ctx context.Context, left, right net.Conn) {
+// TunnelLimits bounds established tunnels. Zero values disable limits.
+type TunnelLimits struct {
+	// IdleTimeout closes tunnel after no data was transferred in either
+	// direction for this period. Idleness is detected with granularity of
+	// half of the timeout.
+	IdleTimeout time.Duration
+	MaxLifetime time.Duration
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// halfClose signals EOF to peer while keeping opposite direction open if
+// connection supports that. Otherwise connection is closed.
+func halfClose(conn net.Conn) {
+	if cw, ok := conn.(closeWriter); ok && cw.CloseWrite() == nil {
+		return
+	}
+	conn.Close()
+}
+
+type tunnelActivity struct {
+	idleTimeout time.Duration
+	last        atomic.Int64
+}
+
+func newTunnelActivity(idleTimeout time.Duration) *tunnelActivity {
+	a := &tunnelActivity{
+		idleTimeout: idleTimeout,
+	}
+	a.touch()
+	return a
+}
+
+func (a *tunnelActivity) touch() {
+	a.last.Store(time.Now().UnixNano())
+}
+
+func (a *tunnelActivity) sinceLast() time.Duration {
+	return time.Since(time.Unix(0, a.last.Load()))
+}
+
+func (a *tunnelActivity) idle() bool {
+	return a.sinceLast() >= a.idleTimeout
+}
+
+// watch calls onIdle once there was no activity in either direction for
+// idle timeout. Returned function stops watching.
+func (a *tunnelActivity) watch(onIdle func()) (stop func()) {
+	if a.idleTimeout <= 0 {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		timer := time.NewTimer(a.idleTimeout)
+		defer timer.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-timer.C:
+			}
+			if left := a.idleTimeout - a.sinceLast(); left > 0 {
+				timer.Reset(left)
+				continue
+			}
+			onIdle()
+			return
+		}
+	}()
+	return func() { close(done) }
+}
+
+// copyWithIdle runs copyFn reading from src until it completes. Read
+// deadlines of src interrupt copyFn periodically to check whole tunnel for
+// idleness, so copyFn can still use zero-copy paths of src.
+func (a *tunnelActivity) copyWithIdle(src net.Conn, copyFn func() (int64, error)) error {
+	if a.idleTimeout <= 0 {
+		_, err := copyFn()
+		return err
+	}
+	defer src.SetReadDeadline(time.Time{})
+	for {
+		src.SetReadDeadline(time.Now().Add(a.idleTimeout / 2))
+		n, err := copyFn()
+		if n > 0 {
+			a.touch()
+		}
+		if err == nil || !errors.Is(err, os.ErrDeadlineExceeded) {
+			return err
+		}
+		if a.idle() {
+			return err
+		}
+	}
+}
+
+type activityReader struct {
+	r   io.Reader
+	act *tunnelActivity
+}
+
+func (r activityReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.act.touch()
+	}
+	return n, err
+}
+
+func proxy(ctx context.Context, left, right net.Conn, limits TunnelLimits) {
+	if limits.MaxLifetime > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, limits.MaxLifetime)
+		defer cancel()
+	}
+	act := newTunnelActivity(limits.IdleTimeout)
 	wg := sync.WaitGroup{}
 	cpy := func(dst, src net.Conn) {
 		defer wg.Done()
-		io.Copy(dst, src)
-		dst.Close()
+		err := act.copyWithIdle(src, func() (int64, error) {
+			return copyStream(dst, src)
+		})
+		if err != nil {
+			// Errors and idle timeout abort both directions
+			dst.Close()
+			src.Close()
+			return
+		}
+		halfClose(dst)
 	}
 	wg.Add(2)
 	go cpy(left, right)
@@ -70,23 +197,49 @@ func proxy(ctx context.Context, left, right net.Conn) {
 		left.Close()
 		right.Close()
 	case <-groupdone:
+		left.Close()
+		right.Close()
 		return
 	}
 	<-groupdone
 	return
 }
 
-func proxyh2(ctx context.Context, leftreader io.ReadCloser, leftwriter io.Writer, right net.Conn) {
+func proxyh2(ctx context.Context, leftreader io.ReadCloser, leftwriter io.Writer, right net.Conn, limits TunnelLimits) {
+	if limits.MaxLifetime > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, limits.MaxLifetime)
+		defer cancel()
+	}
+	act := newTunnelActivity(limits.IdleTimeout)
 	wg := sync.WaitGroup{}
 	ltr := func(dst net.Conn, src io.Reader) {
 		defer wg.Done()
-		io.Copy(dst, src)
-		dst.Close()
+		_, err := copyStream(dst, activityReader{src, act})
+		if err != nil {
+			dst.Close()
+			leftreader.Close()
+			return
+		}
+		halfClose(dst)
 	}
-	rtl := func(dst io.Writer, src io.Reader) {
+	rtl := func(dst io.Writer, src net.Conn) {
 		defer wg.Done()
-		copyBody(dst, src)
+		_, err := copyBody(dst, activityReader{src, act})
+		if err != nil {
+			// Client stream can't be half-closed until handler returns,
+			// so only failures stop reading from client.
+			src.Close()
+			leftreader.Close()
+		}
 	}
+	// Client stream has no read deadlines, so idleness of both directions
+	// is watched for at once and aborts whole tunnel.
+	stop := act.watch(func() {
+		leftreader.Close()
+		right.Close()
+	})
+	defer stop()
 	wg.Add(2)
 	go ltr(right, leftreader)
 	go rtl(leftwriter, right)
@@ -100,6 +253,7 @@ func proxyh2(ctx context.Context, leftreader io.ReadCloser, leftwriter io.Writer
 		leftreader.Close()
 		right.Close()
 	case <-groupdone:
+		right.Close()
 		return
 	}
 	<-groupdone
@@ -197,6 +351,9 @@ func print_proxies(try func(string, func() error) error, logger *CondLogger, ext
 }
 
 func get_endpoint(tunnels *ZGetTunnelsResponse, typ string, trial bool, force_port_field string) (*Endpoint, error) {
+	if tunnels == nil {
+		return nil, errors.New("No tunnels found in API response")
+	}
 	var hostname, ip string
 	for k, v := range tunnels.IPList {
 		hostname = k
@@ -295,17 +452,28 @@ func flush(flusher interface{}) bool {
 	return true
 }
 
-func copyBody(wr io.Writer, body io.Reader) {
-	buf := make([]byte, COPY_BUF)
+// copyBody copies body to wr flushing after every chunk. EOF of body isn't
+// reported as error.
+func copyBody(wr io.Writer, body io.Reader) (int64, error) {
+	bufp := copyBuffers.Get()
+	defer copyBuffers.Put(bufp)
+	buf := *bufp
+	var written int64
 	for {
 		bread, read_err := body.Read(buf)
-		var write_err error
 		if bread > 0 {
-			_, write_err = wr.Write(buf[:bread])
+			bwritten, write_err := wr.Write(buf[:bread])
+			written += int64(bwritten)
+			if write_err != nil {
+				return written, write_err
+			}
 			flush(wr)
 		}
-		if read_err != nil || write_err != nil {
-			break
+		if read_err == io.EOF {
+			return written, nil
+		}
+		if read_err != nil {
+			return written, read_err
 		}
 	}
 }
@@ -317,3 +485,23 @@ func RandRange(low, hi int64) int64 {
 	delta := hi - low
 	return low + rand.New(RandomSource).Int63n(delta+1)
 }
+
+var NoPeerCertificatesError = errors.New("no peer certificates presented")
+
+// verifyPeerCertificates checks certificate chain presented by peer against
+// roots for dnsName regardless of SNI sent.
+func verifyPeerCertificates(certs []*x509.Certificate, dnsName string, roots *x509.CertPool) error {
+	if len(certs) == 0 {
+		return NoPeerCertificatesError
+	}
+	opts := x509.VerifyOptions{
+		DNSName:       dnsName,
+		Intermediates: x509.NewCertPool(),
+		Roots:         roots,
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(opts)
+	return err
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// startTunnel runs proxy between fresh client and server connections
+func startTunnel(t *testing.T, limits TunnelLimits) (client, server net.Conn, done <-chan struct{}) {
+	client, left := tcpPair(t)
+	right, server := tcpPair(t)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	ch := make(chan struct{})
+	go func() {
+		proxy(context.Background(), left, right, limits)
+		close(ch)
+	}()
+	return client, server, ch
+}
+
+func waitDone(t *testing.T, done <-chan struct{}, within time.Duration) {
+	select {
+	case <-done:
+	case <-time.After(within):
+		t.Fatalf("tunnel wasn't closed within %v", within)
+	}
+}
+
+func TestProxyHalfClose(t *testing.T) {
+	client, server, done := startTunnel(t, TunnelLimits{})
+	go func() {
+		req, _ := io.ReadAll(server)
+		io.WriteString(server, "got "+string(req))
+		server.Close()
+	}()
+	io.WriteString(client, "request")
+	client.(*net.TCPConn).CloseWrite()
+	resp, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp) != "got request" {
+		t.Errorf("got %q after half-close, want %q", resp, "got request")
+	}
+	waitDone(t, done, 5*time.Second)
+}
+
+func TestProxyIdleTimeout(t *testing.T) {
+	_, _, done := startTunnel(t, TunnelLimits{IdleTimeout: 100 * time.Millisecond})
+	waitDone(t, done, 5*time.Second)
+}
+
+func TestProxyIdleTimeoutOneWayTraffic(t *testing.T) {
+	client, server, done := startTunnel(t, TunnelLimits{IdleTimeout: 200 * time.Millisecond})
+	go func() {
+		for i := 0; i < 20; i++ {
+			if _, err := server.Write([]byte{byte(i)}); err != nil {
+				return
+			}
+			time.Sleep(30 * time.Millisecond)
+		}
+		server.Close()
+	}()
+	data, _ := io.ReadAll(client)
+	if len(data) != 20 {
+		t.Errorf("got %d bytes, want 20: active tunnel was closed as idle", len(data))
+	}
+	waitDone(t, done, 5*time.Second)
+}
+
+func TestProxyMaxLifetime(t *testing.T) {
+	client, server, done := startTunnel(t, TunnelLimits{MaxLifetime: 100 * time.Millisecond})
+	go io.Copy(server, server)
+	go io.Copy(io.Discard, client)
+	waitDone(t, done, 5*time.Second)
+}
+
+func TestProxyH2IdleTimeoutSilentClient(t *testing.T) {
+	right, server := tcpPair(t)
+	defer server.Close()
+	clientBody, clientWriter := io.Pipe()
+	defer clientWriter.Close()
+	done := make(chan struct{})
+	go func() {
+		proxyh2(context.Background(), clientBody, io.Discard, right, TunnelLimits{IdleTimeout: 100 * time.Millisecond})
+		close(done)
+	}()
+	io.WriteString(server, "response")
+	server.(*net.TCPConn).CloseWrite()
+	waitDone(t, done, 5*time.Second)
+}